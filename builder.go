@@ -0,0 +1,345 @@
+package core
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	ouretl "github.com/ourstudio-se/ouretl-abstractions"
+)
+
+// PluginConfig declares a plugin for a ConfigBuilder, with the same
+// meaning as the keys of a `[[plugin]]` entry in a config file.
+type PluginConfig struct {
+	Name           string
+	Path           string
+	Version        string
+	Priority       int
+	Builtin        string
+	Settings       map[string]interface{}
+	SettingsFile   string
+	SettingsFormat string
+	EnvPrefix      *string
+	Sources        []string
+	Pipeline       string
+	Routes         []string
+	Rules          []RuleConfig
+	Retry          *RetryConfig
+	Restart        *RestartConfig
+}
+
+// RuleConfig declares a rule of a built-in router, like a
+// `[[plugin.rule]]` entry.
+type RuleConfig struct {
+	Route    string
+	JSONPath string
+	Header   string
+	Regex    string
+	Equals   string
+}
+
+// RetryConfig declares the retry policy of a `DataHandlerPlugin`, like
+// a `[plugin.retry]` block.
+type RetryConfig struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Jitter         float64
+}
+
+// RestartConfig declares the restart policy of a `WorkerPlugin`, like a
+// `[plugin.restart]` block.
+type RestartConfig struct {
+	Policy         string
+	MaxRestarts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	ResetWindow    time.Duration
+}
+
+// StageConfig declares a stage of a pipeline, like a `[[stage]]` entry.
+type StageConfig struct {
+	Name   string
+	Plugin string
+	Next   []string
+}
+
+// DeadLetterConfig declares where messages the handler chain fails to
+// process are written, like a `[dead_letter]` section.
+type DeadLetterConfig struct {
+	Type   string
+	Path   string
+	Plugin string
+}
+
+func (pc PluginConfig) definition() *defaultPluginDefinition {
+	def := &defaultPluginDefinition{
+		NameVal:           pc.Name,
+		PathVal:           pc.Path,
+		VersionVal:        pc.Version,
+		PriorityVal:       pc.Priority,
+		BuiltinVal:        pc.Builtin,
+		SettingsVal:       mergeSettings(make(map[string]interface{}), pc.Settings),
+		SettingsFileVal:   pc.SettingsFile,
+		SettingsFormatVal: pc.SettingsFormat,
+		EnvPrefixVal:      pc.EnvPrefix,
+		SourcesVal:        pc.Sources,
+		PipelineVal:       pc.Pipeline,
+		RoutesVal:         pc.Routes,
+	}
+
+	for _, rule := range pc.Rules {
+		def.RulesVal = append(def.RulesVal, &ruleDefinition{
+			Route:    rule.Route,
+			JSONPath: rule.JSONPath,
+			Header:   rule.Header,
+			Regex:    rule.Regex,
+			Equals:   rule.Equals,
+		})
+	}
+	if pc.Retry != nil {
+		def.RetryVal = &retryPolicy{
+			MaxAttempts:    pc.Retry.MaxAttempts,
+			InitialBackoff: duration{Duration: pc.Retry.InitialBackoff},
+			MaxBackoff:     duration{Duration: pc.Retry.MaxBackoff},
+			Jitter:         pc.Retry.Jitter,
+		}
+	}
+	if pc.Restart != nil {
+		def.RestartVal = &restartPolicy{
+			Policy:         pc.Restart.Policy,
+			MaxRestarts:    pc.Restart.MaxRestarts,
+			InitialBackoff: duration{Duration: pc.Restart.InitialBackoff},
+			MaxBackoff:     duration{Duration: pc.Restart.MaxBackoff},
+			ResetWindow:    duration{Duration: pc.Restart.ResetWindow},
+		}
+	}
+
+	return def
+}
+
+// ConfigBuilder builds an `ouretl.Config` in code, for services that
+// embed ouretl-core instead of reading a config file. Once built, the
+// builder can still be changed, and Apply changes the built config the
+// same way a reload of a config file does, calling the same listeners.
+type ConfigBuilder struct {
+	mu      sync.Mutex
+	applyMu sync.Mutex
+	options defaultConfig
+	plugins []PluginConfig
+	stages  []StageConfig
+	config  *defaultConfig
+}
+
+// NewConfigBuilder returns a builder for an empty config.
+func NewConfigBuilder() *ConfigBuilder {
+	return &ConfigBuilder{}
+}
+
+// OverrideSettingsFromEnv sets whether plugin settings are overridden
+// by environment variables, like `inherit_settings_from_env`.
+func (cb *ConfigBuilder) OverrideSettingsFromEnv(overrideFromEnv bool) *ConfigBuilder {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.options.OverrideSettingsFromEnv = overrideFromEnv
+	return cb
+}
+
+// SecretKeyFile sets the key file for encrypted settings, like
+// `secret_key_file`.
+func (cb *ConfigBuilder) SecretKeyFile(keyFilePath string) *ConfigBuilder {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.options.SecretKeyFileVal = keyFilePath
+	return cb
+}
+
+// MessageTimeout sets the timeout for a message to pass the handler
+// chain, like `message_timeout`.
+func (cb *ConfigBuilder) MessageTimeout(timeout time.Duration) *ConfigBuilder {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.options.MessageTimeoutVal = duration{Duration: timeout}
+	return cb
+}
+
+// Concurrency sets the number of messages handled at once, like
+// `concurrency`.
+func (cb *ConfigBuilder) Concurrency(concurrency int) *ConfigBuilder {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.options.ConcurrencyVal = concurrency
+	return cb
+}
+
+// PreserveOriginOrder sets whether messages from the same worker are
+// handled in order, like `preserve_origin_order`.
+func (cb *ConfigBuilder) PreserveOriginOrder(preserveOriginOrder bool) *ConfigBuilder {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.options.PreserveOriginOrderVal = preserveOriginOrder
+	return cb
+}
+
+// Stage adds a pipeline stage, or replaces the stage with the same name
+// in its place. Stages only take effect through Build.
+func (cb *ConfigBuilder) Stage(stage StageConfig) *ConfigBuilder {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	for i, s := range cb.stages {
+		if s.Name == stage.Name {
+			cb.stages[i] = stage
+			return cb
+		}
+	}
+
+	cb.stages = append(cb.stages, stage)
+	return cb
+}
+
+// RemoveStage removes the stage with the given name, if it has been
+// added.
+func (cb *ConfigBuilder) RemoveStage(name string) *ConfigBuilder {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	for i, s := range cb.stages {
+		if s.Name == name {
+			cb.stages = append(cb.stages[:i], cb.stages[i+1:]...)
+			break
+		}
+	}
+
+	return cb
+}
+
+// DeadLetter sets where messages the handler chain fails to process are
+// written, like `[dead_letter]`.
+func (cb *ConfigBuilder) DeadLetter(deadLetter DeadLetterConfig) *ConfigBuilder {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.options.DeadLetterVal = &deadLetterDefinition{
+		Type:   deadLetter.Type,
+		Path:   deadLetter.Path,
+		Plugin: deadLetter.Plugin,
+	}
+	return cb
+}
+
+// Plugin adds a plugin, or replaces the plugin with the same name and
+// version in its place.
+func (cb *ConfigBuilder) Plugin(plugin PluginConfig) *ConfigBuilder {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	for i, p := range cb.plugins {
+		if p.Name == plugin.Name && p.Version == plugin.Version {
+			cb.plugins[i] = plugin
+			return cb
+		}
+	}
+
+	cb.plugins = append(cb.plugins, plugin)
+	return cb
+}
+
+// RemovePlugin removes the plugin with the given name and version, if
+// it has been added.
+func (cb *ConfigBuilder) RemovePlugin(name, version string) *ConfigBuilder {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	for i, p := range cb.plugins {
+		if p.Name == name && p.Version == version {
+			cb.plugins = append(cb.plugins[:i], cb.plugins[i+1:]...)
+			break
+		}
+	}
+
+	return cb
+}
+
+// next builds a new config from the current state of the builder, and
+// fails with a *ValidationError if it has any problems.
+func (cb *ConfigBuilder) next() (*defaultConfig, error) {
+	config := &defaultConfig{
+		OverrideSettingsFromEnv: cb.options.OverrideSettingsFromEnv,
+		SecretKeyFileVal:        cb.options.SecretKeyFileVal,
+		MessageTimeoutVal:       cb.options.MessageTimeoutVal,
+		ConcurrencyVal:          cb.options.ConcurrencyVal,
+		PreserveOriginOrderVal:  cb.options.PreserveOriginOrderVal,
+		DeadLetterVal:           cb.options.DeadLetterVal,
+	}
+	for _, p := range cb.plugins {
+		config.Definitions = append(config.Definitions, p.definition())
+	}
+	for _, s := range cb.stages {
+		config.Stages = append(config.Stages, &stageDefinition{Name: s.Name, Plugin: s.Plugin, Next: s.Next})
+	}
+
+	problems := validateConfig(config, nil)
+	problems = append(problems, config.prepareDefinitions()...)
+	if len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
+
+	return config, nil
+}
+
+// Build returns the config, or a *ValidationError listing every problem
+// with it. A builder can only be built once, and is changed afterwards
+// through Apply.
+func (cb *ConfigBuilder) Build() (ouretl.Config, error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.config != nil {
+		return nil, errors.New("config has already been built, use Apply to change it")
+	}
+
+	config, err := cb.next()
+	if err != nil {
+		return nil, err
+	}
+
+	config.logEnvOverrides()
+	cb.config = config
+
+	return config, nil
+}
+
+// Apply changes the built config to the current state of the builder.
+// Added plugins are appended, removed plugins deactivated, and plugins
+// with a changed priority or changed inline settings are updated, and
+// the listeners of the config are called for every change. Options
+// other than plugins, including stages and the dead letter, only take
+// effect through Build. If the builder has any problem, the config is
+// left unchanged. Listeners may change the builder, but not call Apply.
+func (cb *ConfigBuilder) Apply() error {
+	cb.applyMu.Lock()
+	defer cb.applyMu.Unlock()
+
+	cb.mu.Lock()
+	if cb.config == nil {
+		cb.mu.Unlock()
+		return errors.New("config has not been built yet")
+	}
+
+	config := cb.config
+	nextConfig, err := cb.next()
+	cb.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	config.reload(nextConfig)
+	return nil
+}
@@ -0,0 +1,226 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ourstudio-se/ouretl-abstractions"
+)
+
+func TestThatBuilderBuildsConfig(t *testing.T) {
+	os.Setenv("OURETL_ROUTER_2_ENDPOINT", "http://env")
+	defer os.Unsetenv("OURETL_ROUTER_2_ENDPOINT")
+
+	config, err := NewConfigBuilder().
+		OverrideSettingsFromEnv(true).
+		MessageTimeout(5 * time.Second).
+		Plugin(PluginConfig{Name: "router-2", Builtin: "router", Version: "1.0.0", Priority: 20, Settings: map[string]interface{}{"endpoint": "http://localhost", "batch_size": 10}}).
+		Plugin(PluginConfig{Name: "router-1", Builtin: "router", Version: "1.0.0", Priority: 10}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.(*defaultConfig).MessageTimeout() != 5*time.Second {
+		t.Errorf("Expected message timeout to be 5s, but got '%v'", config.(*defaultConfig).MessageTimeout())
+	}
+
+	pdefs := config.PluginDefinitions()
+	if len(pdefs) != 2 || pdefs[0].Name() != "router-1" || pdefs[1].Name() != "router-2" {
+		t.Fatalf("Expected plugins ordered by priority, but got %v", pdefs)
+	}
+	if !pdefs[1].IsActive() {
+		t.Error("Expected built plugin to be active")
+	}
+	if value, _ := pdefs[1].Settings().Get("endpoint"); value != "http://env" {
+		t.Errorf("Expected environment to override setting 'endpoint', but got '%v'", value)
+	}
+	if value, _ := pdefs[1].Settings().Get("batch_size"); value != int64(10) {
+		t.Errorf("Expected setting 'batch_size' to be 10, but got '%v'", value)
+	}
+}
+
+func TestThatBuilderReportsProblems(t *testing.T) {
+	builder := NewConfigBuilder().
+		Plugin(PluginConfig{Name: "test-1", Path: "/tmp/missing-plugin.so", Version: "1.0.0"})
+
+	if _, err := builder.Build(); err == nil {
+		t.Fatal("Expected plugin with missing file to fail the build")
+	} else if _, ok := err.(*ValidationError); !ok {
+		t.Errorf("Expected a validation error, but got '%v'", err)
+	}
+
+	if err := builder.Apply(); err == nil {
+		t.Error("Expected apply before build to cause an error")
+	}
+
+	builder.RemovePlugin("test-1", "1.0.0")
+	if _, err := builder.Build(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := builder.Build(); err == nil {
+		t.Error("Expected a second build to cause an error")
+	}
+}
+
+func TestThatBuilderChangesCallListeners(t *testing.T) {
+	builder := NewConfigBuilder().
+		Plugin(PluginConfig{Name: "router-1", Builtin: "router", Version: "1.0.0", Priority: 10, Settings: map[string]interface{}{"key": "value"}}).
+		Plugin(PluginConfig{Name: "router-2", Builtin: "router", Version: "1.0.0", Priority: 20})
+
+	config, err := builder.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var added, deactivated, changed, resettled []string
+	config.OnPluginDefinitionAdded(func(pdef ouretl.PluginDefinition) {
+		added = append(added, pdef.Name())
+	})
+	config.OnPluginDefinitionDeactivated(func(pdef ouretl.PluginDefinition) {
+		deactivated = append(deactivated, pdef.Name())
+	})
+	config.(*defaultConfig).OnPluginDefinitionChanged(func(pdef ouretl.PluginDefinition) {
+		changed = append(changed, pdef.Name())
+	})
+	config.(*defaultConfig).OnPluginSettingsChanged(func(pdef ouretl.PluginDefinition) {
+		resettled = append(resettled, pdef.Name())
+	})
+
+	builder.
+		Plugin(PluginConfig{Name: "router-1", Builtin: "router", Version: "1.0.0", Priority: 30, Settings: map[string]interface{}{"key": "changed"}}).
+		Plugin(PluginConfig{Name: "router-3", Builtin: "router", Version: "1.0.0", Priority: 40}).
+		RemovePlugin("router-2", "1.0.0")
+	if err := builder.Apply(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(added) != 1 || added[0] != "router-3" {
+		t.Errorf("Expected 'router-3' to be added, but got %v", added)
+	}
+	if len(deactivated) != 1 || deactivated[0] != "router-2" {
+		t.Errorf("Expected 'router-2' to be deactivated, but got %v", deactivated)
+	}
+	if len(changed) != 1 || changed[0] != "router-1" {
+		t.Errorf("Expected 'router-1' to be reprioritized, but got %v", changed)
+	}
+	if len(resettled) != 1 || resettled[0] != "router-1" {
+		t.Errorf("Expected 'router-1' to have changed settings, but got %v", resettled)
+	}
+
+	pdefs := config.PluginDefinitions()
+	if pdefs[len(pdefs)-1].Name() != "router-3" {
+		t.Errorf("Expected plugins ordered by priority, but got %v", pdefs)
+	}
+	for _, pdef := range pdefs {
+		if pdef.Name() == "router-1" {
+			if value, _ := pdef.Settings().Get("key"); value != "changed" {
+				t.Errorf("Expected setting 'key' of 'router-1' to be 'changed', but got '%v'", value)
+			}
+		}
+	}
+}
+
+func TestThatAppendPluginKeepsSettings(t *testing.T) {
+	settingsFilePath := "/tmp/settings9.toml"
+	ioutil.WriteFile(settingsFilePath, []byte("endpoint = \"http://remote\"\n"), 0600)
+
+	prefix := "APPEND_"
+	pdef := &defaultPluginDefinition{
+		NameVal:         "test-1",
+		VersionVal:      "1.0.0",
+		SettingsFileVal: settingsFilePath,
+		SettingsVal:     map[string]interface{}{"batch_size": int64(10)},
+		EnvPrefixVal:    &prefix,
+		isActive:        true,
+	}
+
+	config := &defaultConfig{}
+	config.AppendPluginDefinition(pdef)
+
+	appended := config.Definitions[0]
+	if appended.SettingsFileVal != settingsFilePath || appended.envPrefix() != &prefix {
+		t.Error("Expected settings file and env prefix to be kept")
+	}
+	if value, _ := appended.Settings().Get("endpoint"); value != "http://remote" {
+		t.Errorf("Expected setting 'endpoint' from the settings file, but got '%v'", value)
+	}
+	if value, _ := appended.Settings().Get("batch_size"); value != int64(10) {
+		t.Errorf("Expected inline setting 'batch_size' to be 10, but got '%v'", value)
+	}
+}
+
+func TestThatAppendPluginWrapsForeignSettings(t *testing.T) {
+	os.Setenv("OURETL_PLUGIN_BATCH_SIZE", "20")
+	defer os.Unsetenv("OURETL_PLUGIN_BATCH_SIZE")
+
+	pdef := &mockPluginDef{active: true, settings: &mockEnvSettings{newTestSettings(map[string]interface{}{
+		"endpoint":   "http://foreign",
+		"batch_size": int64(10),
+		"tls":        map[string]interface{}{"enabled": true},
+	})}}
+
+	config := &defaultConfig{OverrideSettingsFromEnv: true}
+	config.AppendPluginDefinition(pdef)
+
+	settings := config.Definitions[0].Settings()
+	if value, _ := settings.Get("endpoint"); value != "http://foreign" {
+		t.Errorf("Expected setting 'endpoint' from the foreign settings, but got '%v'", value)
+	}
+	if value, _ := settings.Get("batch_size"); value != "20" {
+		t.Errorf("Expected environment to override setting 'batch_size', but got '%v'", value)
+	}
+	if _, ok := settings.Get("missing"); ok {
+		t.Error("Expected setting 'missing' not to be found")
+	}
+
+	tls, err := Settings(settings).GetTable("tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enabled, err := tls.GetBool("enabled"); err != nil || !enabled {
+		t.Errorf("Expected setting 'tls.enabled' from the foreign settings, but got '%v' (%v)", enabled, err)
+	}
+}
+
+func TestThatBuilderBuildsPoliciesStagesAndDeadLetter(t *testing.T) {
+	config, err := NewConfigBuilder().
+		Plugin(PluginConfig{
+			Name: "router-1", Builtin: "router", Version: "1.0.0", Priority: 10,
+			Rules:   []RuleConfig{{Route: "numbers", JSONPath: "$.body", Regex: "^[0-9]+$"}},
+			Retry:   &RetryConfig{MaxAttempts: 3, InitialBackoff: time.Second, MaxBackoff: 5 * time.Second, Jitter: 0.1},
+			Restart: &RestartConfig{Policy: "on-failure", MaxRestarts: 2, ResetWindow: time.Minute},
+		}).
+		Plugin(PluginConfig{Name: "router-2", Builtin: "router", Version: "1.0.0", Priority: 20}).
+		Stage(StageConfig{Name: "route", Plugin: "router-2"}).
+		Stage(StageConfig{Name: "unused", Plugin: "router-2"}).
+		Stage(StageConfig{Name: "route", Plugin: "router-1", Next: []string{"write"}}).
+		Stage(StageConfig{Name: "write", Plugin: "router-2"}).
+		RemoveStage("unused").
+		DeadLetter(DeadLetterConfig{Type: "directory", Path: "/tmp/dead-letters"}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pdef := config.(*defaultConfig).Definitions[0]
+	if rules := pdef.rules(); len(rules) != 1 || rules[0].Route != "numbers" || rules[0].Regex != "^[0-9]+$" {
+		t.Errorf("Expected rule for route 'numbers', but got %v", rules)
+	}
+	if retry := retryPolicyFor(pdef); retry == nil || retry.MaxAttempts != 3 || retry.InitialBackoff.Duration != time.Second || retry.MaxBackoff.Duration != 5*time.Second {
+		t.Errorf("Expected retry policy with 3 attempts, but got %v", retry)
+	}
+	if restart := restartPolicyFor(pdef); restart == nil || restart.Policy != "on-failure" || restart.MaxRestarts != 2 || restart.ResetWindow.Duration != time.Minute {
+		t.Errorf("Expected restart policy 'on-failure', but got %v", restart)
+	}
+
+	stages := config.(*defaultConfig).stageDefinitions()
+	if len(stages) != 2 || stages[0].Name != "route" || stages[0].Plugin != "router-1" || stages[1].Name != "write" {
+		t.Errorf("Expected stages 'route' and 'write', but got %v", stages)
+	}
+	if deadLetter := config.(*defaultConfig).deadLetterDefinition(); deadLetter == nil || deadLetter.Type != "directory" || deadLetter.Path != "/tmp/dead-letters" {
+		t.Errorf("Expected directory dead letter, but got %v", deadLetter)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	core "github.com/ourstudio-se/ouretl-core"
+)
+
+const (
+	defaultConfigFilePath  = "/etc/ouretl/default.conf"
+	defaultShutdownTimeout = 10 * time.Second
+)
+
+const (
+	exitOK           = 0
+	exitConfigError  = 1
+	exitRuntimeError = 3
+	exitWorkersError = 4
+	exitStartError   = 5
+)
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(validate(os.Args[2:]))
+		case "keygen":
+			os.Exit(keygen(os.Args[2:]))
+		case "seal":
+			os.Exit(seal(os.Args[2:]))
+		}
+	}
+
+	os.Exit(run())
+}
+
+func keygen(args []string) int {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	keyFilePath := flags.String("key-file", "", "path to write a new secret key to")
+	flags.Parse(args)
+
+	if *keyFilePath == "" {
+		fmt.Fprintln(os.Stderr, "A -key-file path is required")
+		return exitConfigError
+	}
+
+	key, err := core.GenerateSecretKey()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not generate secret key: %v\n", err)
+		return exitConfigError
+	}
+
+	file, err := os.OpenFile(*keyFilePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not create secret key file '%s': %v\n", *keyFilePath, err)
+		return exitConfigError
+	}
+	defer file.Close()
+
+	if _, err := fmt.Fprintln(file, key); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not write secret key file '%s': %v\n", *keyFilePath, err)
+		return exitConfigError
+	}
+
+	return exitOK
+}
+
+func seal(args []string) int {
+	flags := flag.NewFlagSet("seal", flag.ExitOnError)
+	keyFilePath := flags.String("key-file", "", "path to the secret key file, as created by `keygen`")
+	flags.Parse(args)
+
+	key, err := core.ReadSecretKeyFile(*keyFilePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read secret key file '%s': %v\n", *keyFilePath, err)
+		return exitConfigError
+	}
+
+	secret, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read secret from stdin: %v\n", err)
+		return exitConfigError
+	}
+
+	sealed, err := core.SealSecret(key, strings.TrimRight(string(secret), "\r\n"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not seal secret: %v\n", err)
+		return exitConfigError
+	}
+
+	fmt.Println(sealed)
+	return exitOK
+}
+
+func validate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	configFilePath := flags.String("config", defaultConfigFilePath, "path to an ouretl configuration file")
+	configFormat := flags.String("config-format", "", "format of the configuration file, one of 'toml', 'yaml' or 'json' (picked by file extension if empty)")
+	flags.Parse(args)
+
+	err := core.ValidateConfigFile(*configFilePath, *configFormat)
+	if err == nil {
+		fmt.Printf("Config file '%s' is valid\n", *configFilePath)
+		return exitOK
+	}
+
+	ve, ok := err.(*core.ValidationError)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Could not read config file '%s': %v\n", *configFilePath, err)
+		return exitConfigError
+	}
+
+	fmt.Fprintf(os.Stderr, "Config file '%s' has %d problem(s):\n", *configFilePath, len(ve.Problems))
+	for _, problem := range ve.Problems {
+		fmt.Fprintf(os.Stderr, "  - %s\n", problem)
+	}
+
+	return exitConfigError
+}
+
+func run() int {
+	configFilePath := flag.String("config", defaultConfigFilePath, "path to an ouretl configuration file")
+	configFormat := flag.String("config-format", "", "format of the configuration file, one of 'toml', 'yaml' or 'json' (picked by file extension if empty)")
+	strict := flag.Bool("strict", false, "refuse to start, or to reload, a config file with unknown keys or other problems")
+	shutdownTimeout := flag.Duration("shutdown-timeout", defaultShutdownTimeout, "maximum time to drain in-flight messages on shutdown")
+	metricsAddr := flag.String("metrics-addr", "", "address to serve metrics on at /debug/vars, e.g. ':9102' (disabled if empty)")
+	flag.Parse()
+
+	newConfig := core.NewDefaultConfigFromFile
+	if *strict {
+		newConfig = core.NewStrictConfigFromFile
+	}
+
+	config, err := newConfig(*configFilePath, *configFormat)
+	if err != nil {
+		log.Errorf("Could not read config file '%s': %v", *configFilePath, err)
+		return exitConfigError
+	}
+
+	log.Infof("Using config file '%s'", *configFilePath)
+
+	if *metricsAddr != "" {
+		go serveMetrics(*metricsAddr)
+	}
+
+	runtime := core.NewRuntime(config)
+	if err := runtime.Start(context.Background()); err != nil {
+		log.Errorf("Could not start runtime: %v", err)
+		return exitStartError
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	exitCode := exitOK
+	select {
+	case sig := <-signals:
+		log.Infof("Received signal '%s', shutting down", sig)
+	case <-runtime.WorkersExhausted():
+		log.Error("No `WorkerPlugin` is running, shutting down")
+		exitCode = exitWorkersError
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	if _, err := runtime.Shutdown(ctx); err != nil {
+		log.Error(err)
+		return exitRuntimeError
+	}
+
+	return exitCode
+}
+
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	log.Infof("Serving metrics on '%s'", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Error(err)
+	}
+}
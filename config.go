@@ -1,12 +1,13 @@
 package core
 
 import (
+	"fmt"
 	"os"
+	"reflect"
 	"sort"
+	"sync"
 	"time"
 
-	"github.com/BurntSushi/toml"
-	"github.com/radovskyb/watcher"
 	log "github.com/sirupsen/logrus"
 
 	ouretl "github.com/ourstudio-se/ouretl-abstractions"
@@ -20,12 +21,51 @@ var (
 	pluginDefinitionMissing  pluginDefinitionStatus = 30
 )
 
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+func (d *duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var text string
+	if err := unmarshal(&text); err != nil {
+		return err
+	}
+
+	return d.UnmarshalText([]byte(text))
+}
+
+// defaultConfig is safe for concurrent use. Definitions and listeners
+// are guarded by mu, while listeners are called without holding it, so
+// that they can read the config. Reloads are serialized by reloadMu,
+// since both the file watch and a ConfigBuilder may reload the config.
 type defaultConfig struct {
-	OverrideSettingsFromEnv     bool                       `toml:"inherit_settings_from_env"`
-	Definitions                 []*defaultPluginDefinition `toml:"plugin"`
+	mu                          sync.RWMutex
+	reloadMu                    sync.Mutex
+	IncludeVal                  []string                   `toml:"include" json:"include" yaml:"include"`
+	OverrideSettingsFromEnv     bool                       `toml:"inherit_settings_from_env" json:"inherit_settings_from_env" yaml:"inherit_settings_from_env"`
+	SecretKeyFileVal            string                     `toml:"secret_key_file" json:"secret_key_file" yaml:"secret_key_file"`
+	MessageTimeoutVal           duration                   `toml:"message_timeout" json:"message_timeout" yaml:"message_timeout"`
+	ConcurrencyVal              int                        `toml:"concurrency" json:"concurrency" yaml:"concurrency"`
+	PreserveOriginOrderVal      bool                       `toml:"preserve_origin_order" json:"preserve_origin_order" yaml:"preserve_origin_order"`
+	DeadLetterVal               *deadLetterDefinition      `toml:"dead_letter" json:"dead_letter" yaml:"dead_letter"`
+	Stages                      []*stageDefinition         `toml:"stage" json:"stage" yaml:"stage"`
+	Definitions                 []*defaultPluginDefinition `toml:"plugin" json:"plugin" yaml:"plugin"`
 	onAddChangeListeners        []func(ouretl.PluginDefinition)
 	onActivateChangeListeners   []func(ouretl.PluginDefinition)
 	onDeactivateChangeListeners []func(ouretl.PluginDefinition)
+	onChangeListeners           []func(ouretl.PluginDefinition)
+	onSettingsChangeListeners   []func(ouretl.PluginDefinition)
+	onBinaryChangeListeners     []func(ouretl.PluginDefinition)
+	includes                    []string
+	includedFiles               []string
+	format                      string
+	strict                      bool
 }
 
 func newDefaultConfig() ouretl.Config {
@@ -34,107 +74,302 @@ func newDefaultConfig() ouretl.Config {
 }
 
 func NewDefaultConfigFromTOMLFile(configFilePath string) (ouretl.Config, error) {
-	config, err := readConfigFromFile(configFilePath)
+	return newConfigFromFile(configFilePath, FormatTOML, false)
+}
+
+// NewStrictConfigFromTOMLFile reads the config file like
+// NewDefaultConfigFromTOMLFile, but fails with a *ValidationError if
+// the file has any problems. Reloads of a strict config that has
+// problems are rejected.
+func NewStrictConfigFromTOMLFile(configFilePath string) (ouretl.Config, error) {
+	return newConfigFromFile(configFilePath, FormatTOML, true)
+}
+
+// NewDefaultConfigFromFile reads a config file in TOML, YAML or JSON.
+// If format is empty, it is picked by the extension of the file.
+func NewDefaultConfigFromFile(configFilePath string, format string) (ouretl.Config, error) {
+	return newConfigFromFile(configFilePath, format, false)
+}
+
+// NewStrictConfigFromFile reads a config file like
+// NewDefaultConfigFromFile, in strict mode.
+func NewStrictConfigFromFile(configFilePath string, format string) (ouretl.Config, error) {
+	return newConfigFromFile(configFilePath, format, true)
+}
+
+func newConfigFromFile(configFilePath string, format string, strict bool) (ouretl.Config, error) {
+	format, err := formatFor(configFilePath, format)
 	if err != nil {
 		return nil, err
 	}
 
+	config, err := readConfig(configFilePath, format, strict)
+	if err != nil {
+		return nil, err
+	}
+
+	config.logEnvOverrides()
 	go config.createFileWatch(configFilePath)
 
 	return config, nil
 }
 
 func readConfigFromFile(configFilePath string) (*defaultConfig, error) {
+	format, err := formatFor(configFilePath, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return readConfig(configFilePath, format, false)
+}
+
+func readConfig(configFilePath string, format string, strict bool) (*defaultConfig, error) {
 	if _, err := os.Stat(configFilePath); err != nil {
 		return nil, err
 	}
 
 	var config defaultConfig
-	if _, err := toml.DecodeFile(configFilePath, &config); err != nil {
+	undecoded, err := decodeFile(configFilePath, format, &config)
+	if err != nil {
 		return nil, err
 	}
 
-	for i, def := range config.Definitions {
+	interpolateProblems := interpolate(&config)
+	includeProblems := config.mergeIncludes(configFilePath)
+
+	problems := validateConfig(&config, undecoded)
+	problems = append(problems, interpolateProblems...)
+	problems = append(problems, includeProblems...)
+
+	problems = append(problems, config.prepareDefinitions()...)
+
+	if strict && len(problems) > 0 {
+		return nil, &ValidationError{FilePath: configFilePath, Problems: problems}
+	}
+	for _, problem := range problems {
+		log.Warnf("Config file '%s': %s", configFilePath, problem)
+	}
+
+	config.format = format
+	config.strict = strict
+
+	return &config, nil
+}
+
+// prepareDefinitions applies defaults to the declared definitions, reads
+// their settings and activates them, and returns the problems with their
+// settings.
+func (dc *defaultConfig) prepareDefinitions() []string {
+	var problems []string
+	for i, def := range dc.Definitions {
 		if def.PriorityVal < 1 {
 			def.PriorityVal = i
 		}
 
-		if def.SettingsFileVal != "" {
-			def.settings = readSettingsFromTOMLFile(def.SettingsFileVal)
-		} else {
-			def.settings = &defaultPluginSettings{
-				settings: make(map[string]interface{}),
-			}
+		def.SettingsVal = normalizeSettings(def.SettingsVal)
+		def.settings, def.settingsErr = readSettings(workerKey(def), def.SettingsVal, def.SettingsFileVal, def.SettingsFormatVal, dc.SecretKeyFileVal)
+		if def.settingsErr != nil {
+			problems = append(problems, fmt.Sprintf("%s has invalid settings: %v", describe(def), def.settingsErr))
 		}
 
-		def.settings.overrideFromEnv = config.OverrideSettingsFromEnv
+		def.settings.overrideFromEnv = dc.OverrideSettingsFromEnv
+		def.settings.envPrefix = envPrefixForPlugin(def)
 
 		def.isActive = true
 	}
 
-	sort.Sort(byPriority(config.Definitions))
-	return &config, nil
+	sort.Sort(byPriority(dc.Definitions))
+	return problems
 }
 
 func (dc *defaultConfig) PluginDefinitions() []ouretl.PluginDefinition {
 	var definitions []ouretl.PluginDefinition
-	for _, def := range dc.Definitions {
+	for _, def := range dc.definitions() {
 		definitions = append(definitions, def)
 	}
 
 	return definitions
 }
 
+func (dc *defaultConfig) definitions() []*defaultPluginDefinition {
+	dc.mu.RLock()
+	defer dc.mu.RUnlock()
+
+	return append([]*defaultPluginDefinition(nil), dc.Definitions...)
+}
+
+func (dc *defaultConfig) listen(listeners *[]func(ouretl.PluginDefinition), fn func(ouretl.PluginDefinition)) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	*listeners = append(*listeners, fn)
+}
+
+func (dc *defaultConfig) notify(listeners *[]func(ouretl.PluginDefinition), pdef ouretl.PluginDefinition) {
+	dc.mu.RLock()
+	fns := append([](func(ouretl.PluginDefinition))(nil), *listeners...)
+	dc.mu.RUnlock()
+
+	for _, fn := range fns {
+		fn(pdef)
+	}
+}
+
+func (dc *defaultConfig) logEnvOverrides() {
+	for _, def := range dc.definitions() {
+		overrides := def.settings.overridden()
+
+		keys := make([]string, 0, len(overrides))
+		for key := range overrides {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			log.Infof("Plugin '%s (v%s)' setting '%s' is overridden by environment variable '%s'", def.Name(), def.Version(), key, overrides[key])
+		}
+	}
+}
+
+func (dc *defaultConfig) MessageTimeout() time.Duration {
+	return dc.MessageTimeoutVal.Duration
+}
+
+func (dc *defaultConfig) Concurrency() int {
+	return dc.ConcurrencyVal
+}
+
+func (dc *defaultConfig) PreserveOriginOrder() bool {
+	return dc.PreserveOriginOrderVal
+}
+
+func (dc *defaultConfig) deadLetterDefinition() *deadLetterDefinition {
+	return dc.DeadLetterVal
+}
+
+func (dc *defaultConfig) stageDefinitions() []*stageDefinition {
+	return dc.Stages
+}
+
 func (dc *defaultConfig) AppendPluginDefinition(pdef ouretl.PluginDefinition) error {
-	dc.Definitions = append(dc.Definitions, &defaultPluginDefinition{
-		NameVal:     pdef.Name(),
-		PathVal:     pdef.FilePath(),
-		VersionVal:  pdef.Version(),
-		PriorityVal: pdef.Priority(),
-		isActive:    pdef.IsActive(),
-	})
+	settingsFile, settingsFormat := settingsFileFor(pdef)
+	settingsErr := settingsErrorFor(pdef)
+
+	settings, ok := pdef.Settings().(*defaultPluginSettings)
+	if !ok || settings == nil {
+		settings, settingsErr = readSettings(workerKey(pdef), inlineSettingsFor(pdef), settingsFile, settingsFormat, dc.SecretKeyFileVal)
+		if settingsErr != nil {
+			log.Errorf("Plugin '%s (v%s)' has invalid settings: %v", pdef.Name(), pdef.Version(), settingsErr)
+		}
 
-	sort.Sort(byPriority(dc.Definitions))
+		settings.overrideFromEnv = dc.OverrideSettingsFromEnv
+		settings.envPrefix = envPrefixForPlugin(pdef)
+		if !ok && pdef.Settings() != nil {
+			settings.fallback = pdef.Settings()
+		}
+	}
 
-	for _, listener := range dc.onAddChangeListeners {
-		listener(pdef)
+	definition := &defaultPluginDefinition{
+		NameVal:           pdef.Name(),
+		PathVal:           pdef.FilePath(),
+		VersionVal:        pdef.Version(),
+		PriorityVal:       pdef.Priority(),
+		SettingsFileVal:   settingsFile,
+		SettingsFormatVal: settingsFormat,
+		SettingsVal:       inlineSettingsFor(pdef),
+		EnvPrefixVal:      envPrefixFor(pdef),
+		RetryVal:          retryPolicyFor(pdef),
+		RestartVal:        restartPolicyFor(pdef),
+		SourcesVal:        sourcesFor(pdef),
+		PipelineVal:       pipelineNameFor(pdef),
+		RoutesVal:         routesFor(pdef),
+		BuiltinVal:        builtinFor(pdef),
+		RulesVal:          rulesFor(pdef),
+		isActive:          pdef.IsActive(),
+		settings:          settings,
+		settingsErr:       settingsErr,
 	}
+	dc.mu.Lock()
+	dc.Definitions = append(dc.Definitions, definition)
+	sort.Sort(byPriority(dc.Definitions))
+	dc.mu.Unlock()
+
+	dc.notify(&dc.onAddChangeListeners, definition)
 
 	return nil
 }
 
 func (dc *defaultConfig) OnPluginDefinitionAdded(fn func(ouretl.PluginDefinition)) {
-	dc.onAddChangeListeners = append(dc.onAddChangeListeners, fn)
+	dc.listen(&dc.onAddChangeListeners, fn)
 }
 
 func (dc *defaultConfig) OnPluginDefinitionActivated(fn func(ouretl.PluginDefinition)) {
-	dc.onActivateChangeListeners = append(dc.onActivateChangeListeners, fn)
+	dc.listen(&dc.onActivateChangeListeners, fn)
 }
 
 func (dc *defaultConfig) OnPluginDefinitionDeactivated(fn func(ouretl.PluginDefinition)) {
-	dc.onDeactivateChangeListeners = append(dc.onDeactivateChangeListeners, fn)
+	dc.listen(&dc.onDeactivateChangeListeners, fn)
+}
+
+// OnPluginDefinitionChanged registers a listener for definitions that
+// remain active across a config reload, but whose priority has changed.
+func (dc *defaultConfig) OnPluginDefinitionChanged(fn func(ouretl.PluginDefinition)) {
+	dc.listen(&dc.onChangeListeners, fn)
+}
+
+// OnPluginSettingsChanged registers a listener for definitions whose
+// settings file has changed.
+func (dc *defaultConfig) OnPluginSettingsChanged(fn func(ouretl.PluginDefinition)) {
+	dc.listen(&dc.onSettingsChangeListeners, fn)
+}
+
+// OnPluginBinaryChanged registers a listener for definitions whose
+// plugin binary has been replaced.
+func (dc *defaultConfig) OnPluginBinaryChanged(fn func(ouretl.PluginDefinition)) {
+	dc.listen(&dc.onBinaryChangeListeners, fn)
 }
 
-func (dc *defaultConfig) updateStatusTo(isActive bool, pdef ouretl.PluginDefinition) {
-	for _, p := range dc.Definitions {
+func (dc *defaultConfig) findDefinition(pdef ouretl.PluginDefinition) *defaultPluginDefinition {
+	for _, p := range dc.definitions() {
 		if p.Name() == pdef.Name() && p.Version() == pdef.Version() {
-			p.isActive = isActive
+			return p
 		}
 	}
+
+	return nil
 }
 
-func (dc *defaultConfig) Activate(pdef ouretl.PluginDefinition) {
-	dc.updateStatusTo(true, pdef)
-	for _, listener := range dc.onActivateChangeListeners {
-		listener(pdef)
+func (dc *defaultConfig) updateStatusTo(isActive bool, pdef ouretl.PluginDefinition) ouretl.PluginDefinition {
+	p := dc.findDefinition(pdef)
+	if p == nil {
+		return pdef
 	}
+
+	p.setActive(isActive)
+	return p
+}
+
+func (dc *defaultConfig) Activate(pdef ouretl.PluginDefinition) {
+	dc.notify(&dc.onActivateChangeListeners, dc.updateStatusTo(true, pdef))
 }
 
 func (dc *defaultConfig) Deactivate(pdef ouretl.PluginDefinition) {
-	dc.updateStatusTo(false, pdef)
-	for _, listener := range dc.onDeactivateChangeListeners {
-		listener(pdef)
+	dc.notify(&dc.onDeactivateChangeListeners, dc.updateStatusTo(false, pdef))
+}
+
+func (dc *defaultConfig) updatePriority(pdef ouretl.PluginDefinition) {
+	p := dc.findDefinition(pdef)
+	if p == nil {
+		return
 	}
+
+	p.setPriority(pdef.Priority())
+
+	dc.mu.Lock()
+	sort.Sort(byPriority(dc.Definitions))
+	dc.mu.Unlock()
+
+	dc.notify(&dc.onChangeListeners, p)
 }
 
 func (dc *defaultConfig) findAddedDefinitions(nextConfig *defaultConfig) []ouretl.PluginDefinition {
@@ -167,6 +402,58 @@ func (dc *defaultConfig) findActivatedDefinitions(nextConfig *defaultConfig) []o
 	return pdefs
 }
 
+func (dc *defaultConfig) findReprioritizedDefinitions(nextConfig *defaultConfig) []ouretl.PluginDefinition {
+	var pdefs []ouretl.PluginDefinition
+
+	for _, pdef := range nextConfig.PluginDefinitions() {
+		current := dc.findDefinition(pdef)
+		if current != nil && current.IsActive() && pdef.IsActive() && current.Priority() != pdef.Priority() {
+			pdefs = append(pdefs, pdef)
+		}
+	}
+
+	return pdefs
+}
+
+func (dc *defaultConfig) findResettledDefinitions(nextConfig *defaultConfig) []ouretl.PluginDefinition {
+	var pdefs []ouretl.PluginDefinition
+
+	for _, pdef := range nextConfig.PluginDefinitions() {
+		current := dc.findDefinition(pdef)
+		if current != nil && !reflect.DeepEqual(current.inlineSettings(), inlineSettingsFor(pdef)) {
+			pdefs = append(pdefs, pdef)
+		}
+	}
+
+	return pdefs
+}
+
+func (dc *defaultConfig) updateInlineSettings(pdef ouretl.PluginDefinition) {
+	p := dc.findDefinition(pdef)
+	if p == nil {
+		return
+	}
+
+	p.setInlineSettings(inlineSettingsFor(pdef))
+	dc.refreshSettings(p)
+}
+
+// refreshSettings re-reads the settings of a definition, and tells the
+// listeners if they could be read.
+func (dc *defaultConfig) refreshSettings(def *defaultPluginDefinition) {
+	settings, err := readSettings(workerKey(def), def.inlineSettings(), def.SettingsFileVal, def.SettingsFormatVal, dc.SecretKeyFileVal)
+	if err != nil {
+		log.Errorf("Plugin '%s (v%s)' settings changed, but could not be read -- keeping the previous settings: %v", def.Name(), def.Version(), err)
+		return
+	}
+
+	def.settings.replace(settings)
+	def.setSettingsError(nil)
+	log.Infof("Plugin '%s (v%s)' settings changed", def.Name(), def.Version())
+
+	dc.notify(&dc.onSettingsChangeListeners, def)
+}
+
 func (dc *defaultConfig) findRemovedDefinitions(nextConfig *defaultConfig) []ouretl.PluginDefinition {
 	var pdefs []ouretl.PluginDefinition
 
@@ -182,45 +469,51 @@ func (dc *defaultConfig) findRemovedDefinitions(nextConfig *defaultConfig) []our
 	return pdefs
 }
 
-func (dc *defaultConfig) createFileWatch(configFilePath string) {
-	w := watcher.New()
-	w.FilterOps(watcher.Write)
-
-	go func() {
-		for {
-			select {
-			case <-w.Event:
-				nextConfig, err := readConfigFromFile(configFilePath)
-				if err == nil {
-					added := dc.findAddedDefinitions(nextConfig)
-					for _, a := range added {
-						dc.AppendPluginDefinition(a)
-					}
-
-					activated := dc.findActivatedDefinitions(nextConfig)
-					for _, a := range activated {
-						dc.Activate(a)
-					}
-
-					removed := dc.findRemovedDefinitions(nextConfig)
-					for _, r := range removed {
-						dc.Deactivate(r)
-					}
-				}
-			case err := <-w.Error:
-				log.Warn(err)
-			case <-w.Closed:
-				return
-			}
-		}
-	}()
-
-	if err := w.Add(configFilePath); err != nil {
-		log.Error(err)
-	}
-
-	if err := w.Start(time.Millisecond * 100); err != nil {
-		log.Error(err)
+func (dc *defaultConfig) reload(nextConfig *defaultConfig) {
+	dc.reloadMu.Lock()
+	defer dc.reloadMu.Unlock()
+
+	removed := dc.findRemovedDefinitions(nextConfig)
+
+	added := dc.findAddedDefinitions(nextConfig)
+	for _, a := range added {
+		dc.retireReplacedVersions(a, removed)
+		dc.AppendPluginDefinition(a)
+	}
+
+	activated := dc.findActivatedDefinitions(nextConfig)
+	for _, a := range activated {
+		dc.Activate(a)
+	}
+
+	reprioritized := dc.findReprioritizedDefinitions(nextConfig)
+	for _, r := range reprioritized {
+		dc.updatePriority(r)
+	}
+
+	resettled := dc.findResettledDefinitions(nextConfig)
+	for _, r := range resettled {
+		dc.updateInlineSettings(r)
+	}
+
+	for _, r := range removed {
+		dc.Deactivate(r)
+	}
+}
+
+// retireReplacedVersions marks the removed versions of the plugin pdef
+// is a new version of as inactive before pdef is added, so that the
+// new version takes their place at once, instead of both handling
+// messages until they are deactivated.
+func (dc *defaultConfig) retireReplacedVersions(pdef ouretl.PluginDefinition, removed []ouretl.PluginDefinition) {
+	for _, r := range removed {
+		if r.Name() != pdef.Name() {
+			continue
+		}
+
+		if p := dc.findDefinition(r); p != nil {
+			p.setActive(false)
+		}
 	}
 }
 
@@ -1,8 +1,12 @@
 package core
 
 import (
+	"context"
 	"io/ioutil"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/ourstudio-se/ouretl-abstractions"
 )
@@ -71,3 +75,166 @@ func TestThatAppendPluginCallsChangeListener(t *testing.T) {
 		t.Errorf("Changed config instance does not contain added plugin definition")
 	}
 }
+
+func TestThatReadConfigParsesMessageTimeout(t *testing.T) {
+	configFilePath := "/tmp/config3.conf"
+	configString := "message_timeout = \"1m30s\"\n\n"
+	ioutil.WriteFile(configFilePath, []byte(configString), 0600)
+
+	config, err := readConfigFromFile(configFilePath)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if config.MessageTimeout() != 90*time.Second {
+		t.Errorf("Expected message timeout of %v did not match read value %v", 90*time.Second, config.MessageTimeout())
+	}
+}
+
+func newRouterDefinition(name string, priority int) *defaultPluginDefinition {
+	return &defaultPluginDefinition{
+		NameVal:     name,
+		VersionVal:  "1.0.0",
+		PriorityVal: priority,
+		BuiltinVal:  builtinRouter,
+		RulesVal:    []*ruleDefinition{{Route: "all"}},
+		settings:    &defaultPluginSettings{},
+		isActive:    true,
+	}
+}
+
+func TestThatConfigCanBeReloadedDuringTraffic(t *testing.T) {
+	config := &defaultConfig{Definitions: []*defaultPluginDefinition{
+		newRouterDefinition("router-1", 1),
+		newRouterDefinition("router-2", 2),
+	}}
+	pool := newHandlerPoolFromConfig(config)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				_ = proxyDataMessage(ctx, pool(), &DefaultDataMessage{id: "test", data: []byte("test")})
+				for _, pdef := range config.PluginDefinitions() {
+					_ = pdef.IsActive() && pdef.Priority() > 0
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 50; i++ {
+		config.reload(&defaultConfig{Definitions: []*defaultPluginDefinition{
+			newRouterDefinition("router-1", 3),
+		}})
+		config.reload(&defaultConfig{Definitions: []*defaultPluginDefinition{
+			newRouterDefinition("router-1", 1),
+			newRouterDefinition("router-2", 2),
+		}})
+	}
+
+	cancel()
+	wg.Wait()
+
+	pdefs := config.PluginDefinitions()
+	if len(pdefs) != 2 {
+		t.Fatalf("Expected 2 plugin definitions after reloading, but got %d", len(pdefs))
+	}
+	for i, name := range []string{"router-1", "router-2"} {
+		if pdefs[i].Name() != name || pdefs[i].Priority() != i+1 || !pdefs[i].IsActive() {
+			t.Errorf("Expected '%s' to be active with priority %d after reloading, but got '%s' with priority %d, active %v", name, i+1, pdefs[i].Name(), pdefs[i].Priority(), pdefs[i].IsActive())
+		}
+	}
+
+	handlers := pool()
+	if len(handlers) != 2 {
+		t.Fatalf("Expected 2 handlers after reloading, but got %d", len(handlers))
+	}
+	for i, name := range []string{"router-1", "router-2"} {
+		if handlers[i].definition.Name() != name || !handlers[i].definition.IsActive() {
+			t.Errorf("Expected active '%s' at position %d after reloading, but got '%s', active %v", name, i, handlers[i].definition.Name(), handlers[i].definition.IsActive())
+		}
+	}
+}
+
+func TestThatConcurrentReloadsAreApplied(t *testing.T) {
+	config := &defaultConfig{Definitions: []*defaultPluginDefinition{
+		newRouterDefinition("router-1", 1),
+		newRouterDefinition("router-2", 2),
+	}}
+	pool := newHandlerPoolFromConfig(config)
+
+	// A slow listener leaves room for the other reload to run while the
+	// first one is adding 'router-3'.
+	config.OnPluginDefinitionAdded(func(pdef ouretl.PluginDefinition) {
+		if pdef.Name() == "router-3" {
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		config.reload(&defaultConfig{Definitions: []*defaultPluginDefinition{
+			newRouterDefinition("router-1", 1),
+			newRouterDefinition("router-3", 3),
+		}})
+	}()
+	go func() {
+		defer wg.Done()
+		time.Sleep(time.Millisecond)
+		config.reload(&defaultConfig{Definitions: []*defaultPluginDefinition{
+			newRouterDefinition("router-2", 2),
+			newRouterDefinition("router-4", 4),
+		}})
+	}()
+	wg.Wait()
+
+	var active []string
+	for _, pdef := range config.PluginDefinitions() {
+		if pdef.IsActive() {
+			active = append(active, pdef.Name())
+		}
+	}
+	state := strings.Join(active, ",")
+	if state != "router-2,router-4" && state != "router-1,router-3" {
+		t.Fatalf("Expected the active plugin definitions of either reload, but got '%s'", state)
+	}
+
+	var loaded []string
+	for _, w := range pool() {
+		loaded = append(loaded, w.definition.Name())
+	}
+	if strings.Join(loaded, ",") != state {
+		t.Errorf("Expected handlers '%s' to be loaded after reloading, but got '%s'", state, strings.Join(loaded, ","))
+	}
+}
+
+func TestThatListenersCanBeAddedDuringReload(t *testing.T) {
+	config := &defaultConfig{}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			config.OnPluginDefinitionAdded(func(ouretl.PluginDefinition) {})
+			config.OnPluginDefinitionDeactivated(func(ouretl.PluginDefinition) {})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			config.reload(&defaultConfig{Definitions: []*defaultPluginDefinition{newRouterDefinition("router-1", 1)}})
+			config.reload(&defaultConfig{})
+		}
+	}()
+	wg.Wait()
+
+	if len(config.PluginDefinitions()) != 1 {
+		t.Errorf("Expected 1 plugin definition, but got %d", len(config.PluginDefinitions()))
+	}
+}
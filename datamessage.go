@@ -1,9 +1,36 @@
 package core
 
+import ouretl "github.com/ourstudio-se/ouretl-abstractions"
+
+// HeaderedDataMessage extends ouretl.DataMessage with headers, carrying
+// structured information along the handler chain (e.g. content type,
+// source offsets or trace IDs) without adding it to the payload. A
+// DataHandlerPlugin can access them through a type assertion:
+//
+//	if hdm, ok := dm.(core.HeaderedDataMessage); ok {
+//	    contentType, _ := hdm.Header("content-type")
+//	}
+type HeaderedDataMessage interface {
+	ouretl.DataMessage
+	Header(key string) (string, bool)
+	Headers() map[string]string
+	SetHeader(key, value string)
+}
+
+// AuditableDataMessage gives access to the payload exactly as it was
+// published by the worker, before any DataHandlerPlugin transformed it.
+type AuditableDataMessage interface {
+	ouretl.DataMessage
+	OriginalData() []byte
+}
+
 type DefaultDataMessage struct {
-	id     string
-	data   []byte
-	origin string
+	id       string
+	data     []byte
+	original []byte
+	origin   string
+	pipeline string
+	headers  map[string]string
 }
 
 func (dm *DefaultDataMessage) ID() string {
@@ -14,11 +41,56 @@ func (dm *DefaultDataMessage) Data() []byte {
 	return dm.data
 }
 
+// OriginalData returns the payload as published by the worker.
+func (dm *DefaultDataMessage) OriginalData() []byte {
+	if dm.original == nil {
+		return dm.data
+	}
+
+	return dm.original
+}
+
 func (dm *DefaultDataMessage) Origin() string {
 	return dm.origin
 }
 
+func (dm *DefaultDataMessage) Header(key string) (string, bool) {
+	value, ok := dm.headers[key]
+	return value, ok
+}
+
+// Headers returns a copy of all headers of the message.
+func (dm *DefaultDataMessage) Headers() map[string]string {
+	return copyHeaders(dm.headers)
+}
+
+func (dm *DefaultDataMessage) SetHeader(key, value string) {
+	if dm.headers == nil {
+		dm.headers = make(map[string]string)
+	}
+
+	dm.headers[key] = value
+}
+
+// withData derives a new message with the given payload, keeping the
+// ID, origin, original payload and a copy of the headers. The message
+// it is derived from is left untouched.
 func (dm *DefaultDataMessage) withData(data []byte) *DefaultDataMessage {
-	dm.data = data
-	return dm
+	return &DefaultDataMessage{
+		id:       dm.id,
+		data:     data,
+		original: dm.OriginalData(),
+		origin:   dm.origin,
+		pipeline: dm.pipeline,
+		headers:  copyHeaders(dm.headers),
+	}
+}
+
+func copyHeaders(headers map[string]string) map[string]string {
+	c := make(map[string]string, len(headers))
+	for k, v := range headers {
+		c[k] = v
+	}
+
+	return c
 }
@@ -0,0 +1,216 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	ouretl "github.com/ourstudio-se/ouretl-abstractions"
+)
+
+const (
+	deadLetterTypeFile      = "file"
+	deadLetterTypeDirectory = "directory"
+	deadLetterTypePlugin    = "plugin"
+)
+
+// DeadLetter describes a message for which the handler chain returned
+// an error, and which `DataHandlerPlugin` the error originated from.
+type DeadLetter struct {
+	MessageID     string            `json:"message_id"`
+	Origin        string            `json:"origin"`
+	PluginName    string            `json:"plugin_name"`
+	PluginVersion string            `json:"plugin_version"`
+	Error         string            `json:"error"`
+	Payload       []byte            `json:"payload"`
+	Original      []byte            `json:"original_payload,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	FailedAt      time.Time         `json:"failed_at"`
+}
+
+// DeadLetterWriter is a destination for messages that could not be
+// processed by the handler chain. A writer that also implements
+// io.Closer is closed when the runtime shuts down.
+type DeadLetterWriter interface {
+	Write(dl *DeadLetter) error
+}
+
+type deadLetterDefinition struct {
+	Type   string `toml:"type" json:"type" yaml:"type"`
+	Path   string `toml:"path" json:"path" yaml:"path"`
+	Plugin string `toml:"plugin" json:"plugin" yaml:"plugin"`
+}
+
+type handlerError struct {
+	definition ouretl.PluginDefinition
+	message    *DefaultDataMessage
+	err        error
+}
+
+func (he *handlerError) Error() string {
+	return fmt.Sprintf("DataHandlerPlugin '%s (v%s)' returned error: %v", he.definition.Name(), he.definition.Version(), he.err)
+}
+
+func (he *handlerError) Unwrap() error {
+	return he.err
+}
+
+func newDeadLetter(dm ouretl.DataMessage, err error) *DeadLetter {
+	var he *handlerError
+	if errors.As(err, &he) {
+		dm = he.message
+		err = he.err
+	}
+
+	dl := &DeadLetter{
+		MessageID: dm.ID(),
+		Origin:    dm.Origin(),
+		Error:     err.Error(),
+		Payload:   dm.Data(),
+		FailedAt:  time.Now().UTC(),
+	}
+
+	if he != nil {
+		dl.PluginName = he.definition.Name()
+		dl.PluginVersion = he.definition.Version()
+	}
+	if hdm, ok := dm.(HeaderedDataMessage); ok && len(hdm.Headers()) > 0 {
+		dl.Headers = hdm.Headers()
+	}
+	if adm, ok := dm.(AuditableDataMessage); ok {
+		dl.Original = adm.OriginalData()
+	}
+
+	return dl
+}
+
+type fileDeadLetterWriter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileDeadLetterWriter creates a DeadLetterWriter which appends each
+// dead letter as a JSON line to the file at filePath.
+func NewFileDeadLetterWriter(filePath string) (DeadLetterWriter, error) {
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileDeadLetterWriter{file: file}, nil
+}
+
+func (w *fileDeadLetterWriter) Write(dl *DeadLetter) error {
+	line, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	_, err = w.file.Write(append(line, '\n'))
+	return err
+}
+
+func (w *fileDeadLetterWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.file.Close()
+}
+
+type directoryDeadLetterWriter struct {
+	directoryPath string
+}
+
+// NewDirectoryDeadLetterWriter creates a DeadLetterWriter which spools
+// each dead letter as a separate JSON file in directoryPath, named by
+// the message ID.
+func NewDirectoryDeadLetterWriter(directoryPath string) (DeadLetterWriter, error) {
+	if err := os.MkdirAll(directoryPath, 0700); err != nil {
+		return nil, err
+	}
+
+	return &directoryDeadLetterWriter{directoryPath: directoryPath}, nil
+}
+
+func (w *directoryDeadLetterWriter) Write(dl *DeadLetter) error {
+	content, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+
+	fileName := fmt.Sprintf("%s-%d.json", dl.MessageID, dl.FailedAt.UnixNano())
+	tmpFilePath := filepath.Join(w.directoryPath, "."+fileName)
+	if err := ioutil.WriteFile(tmpFilePath, content, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFilePath, filepath.Join(w.directoryPath, fileName))
+}
+
+type pluginDeadLetterWriter struct {
+	pool func() []*wrapper
+	name string
+}
+
+func (w *pluginDeadLetterWriter) Write(dl *DeadLetter) error {
+	content, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+
+	for _, x := range w.pool() {
+		if x.definition.Name() != w.name {
+			continue
+		}
+
+		dm := &DefaultDataMessage{
+			id:     dl.MessageID,
+			data:   content,
+			origin: dl.Origin,
+		}
+
+		return x.handle(context.Background(), dm, func(_ context.Context, _ []byte) error {
+			return nil
+		})
+	}
+
+	return fmt.Errorf("dead letter plugin '%s' is not loaded", w.name)
+}
+
+func newDeadLetterWriter(def *deadLetterDefinition, pool func() []*wrapper) (DeadLetterWriter, error) {
+	switch def.Type {
+	case deadLetterTypeFile:
+		return NewFileDeadLetterWriter(def.Path)
+	case deadLetterTypeDirectory:
+		return NewDirectoryDeadLetterWriter(def.Path)
+	case deadLetterTypePlugin:
+		if def.Plugin == "" {
+			return nil, errors.New("dead letter type 'plugin' requires a plugin name")
+		}
+		return &pluginDeadLetterWriter{pool: pool, name: def.Plugin}, nil
+	}
+
+	return nil, fmt.Errorf("unknown dead letter type '%s'", def.Type)
+}
+
+func withoutHandler(pool func() []*wrapper, name string) func() []*wrapper {
+	return func() []*wrapper {
+		var handlers []*wrapper
+		for _, x := range pool() {
+			if x.definition.Name() != name {
+				handlers = append(handlers, x)
+			}
+		}
+
+		return handlers
+	}
+}
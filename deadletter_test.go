@@ -0,0 +1,202 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ouretl "github.com/ourstudio-se/ouretl-abstractions"
+)
+
+type mockFailingPluginImpl struct {
+	err error
+}
+
+func (m *mockFailingPluginImpl) Handle(_ ouretl.DataMessage, _ func([]byte) error) error {
+	return m.err
+}
+
+type mockTransformPluginImpl struct{}
+
+func (m *mockTransformPluginImpl) Handle(dm ouretl.DataMessage, next func([]byte) error) error {
+	return next(append(dm.Data(), []byte("-transformed")...))
+}
+
+type mockDeadLetterWriter struct {
+	written []*DeadLetter
+}
+
+func (m *mockDeadLetterWriter) Write(dl *DeadLetter) error {
+	m.written = append(m.written, dl)
+	return nil
+}
+
+func TestThatFailingHandlerIsReportedAsDeadLetter(t *testing.T) {
+	rt := NewRuntime(newDefaultConfig())
+	writer := &mockDeadLetterWriter{}
+	rt.SetDeadLetterWriter(writer)
+
+	p1 := &wrapper{
+		definition:     &mockPluginDef{active: true},
+		implementation: &mockTransformPluginImpl{},
+	}
+	p2 := &wrapper{
+		definition:     &defaultPluginDefinition{NameVal: "failing", VersionVal: "2.0.0", isActive: true},
+		implementation: &mockFailingPluginImpl{err: errors.New("sink unavailable")},
+	}
+
+	pool := func() []*wrapper { return []*wrapper{p1, p2} }
+	rt.process(pool, &DefaultDataMessage{id: "test", data: []byte("test"), origin: "worker"})
+
+	if len(writer.written) != 1 {
+		t.Fatalf("Expected 1 dead letter, but %d were written", len(writer.written))
+	}
+
+	dl := writer.written[0]
+	if dl.MessageID != "test" || dl.Origin != "worker" {
+		t.Errorf("Dead letter did not contain message ID and origin, got '%s' and '%s'", dl.MessageID, dl.Origin)
+	}
+	if dl.PluginName != "failing" || dl.PluginVersion != "2.0.0" {
+		t.Errorf("Dead letter did not point out failing plugin, got '%s (v%s)'", dl.PluginName, dl.PluginVersion)
+	}
+	if dl.Error != "sink unavailable" {
+		t.Errorf("Expected dead letter error '%s' did not match '%s'", "sink unavailable", dl.Error)
+	}
+	if string(dl.Payload) != "test-transformed" {
+		t.Errorf("Expected dead letter payload '%s' did not match '%s'", "test-transformed", string(dl.Payload))
+	}
+}
+
+func TestThatFileDeadLetterWriterAppendsJSONLines(t *testing.T) {
+	filePath := filepath.Join(os.TempDir(), "ouretl-dead-letters.jsonl")
+	os.Remove(filePath)
+	defer os.Remove(filePath)
+
+	writer, err := NewFileDeadLetterWriter(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = writer.Write(&DeadLetter{MessageID: "1", Payload: []byte("first")})
+	_ = writer.Write(&DeadLetter{MessageID: "2", Payload: []byte("second")})
+	writer.(*fileDeadLetterWriter).Close()
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var records []DeadLetter
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var dl DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &dl); err != nil {
+			t.Error(err)
+		}
+		records = append(records, dl)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 dead letter lines, but read %d", len(records))
+	}
+	if string(records[1].Payload) != "second" {
+		t.Errorf("Expected payload '%s' did not match read value '%s'", "second", string(records[1].Payload))
+	}
+}
+
+func TestThatDirectoryDeadLetterWriterSpoolsOneFilePerMessage(t *testing.T) {
+	directoryPath, err := ioutil.TempDir("", "ouretl-dead-letters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directoryPath)
+
+	writer, err := NewDirectoryDeadLetterWriter(directoryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = writer.Write(&DeadLetter{MessageID: "1"})
+	_ = writer.Write(&DeadLetter{MessageID: "2"})
+
+	files, _ := ioutil.ReadDir(directoryPath)
+	if len(files) != 2 {
+		t.Errorf("Expected 2 spooled dead letters, but found %d files", len(files))
+	}
+}
+
+func TestThatDeadLetterPluginReceivesRecord(t *testing.T) {
+	var received ouretl.DataMessage
+	sink := &wrapper{
+		definition: &defaultPluginDefinition{NameVal: "dead-letter-sink", isActive: true},
+		implementation: &mockDataRecorder{record: func(dm ouretl.DataMessage) {
+			received = dm
+		}},
+	}
+
+	writer, err := newDeadLetterWriter(&deadLetterDefinition{Type: deadLetterTypePlugin, Plugin: "dead-letter-sink"}, func() []*wrapper {
+		return []*wrapper{sink}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writer.Write(&DeadLetter{MessageID: "test"}); err != nil {
+		t.Error(err)
+	}
+
+	var dl DeadLetter
+	if received == nil || json.Unmarshal(received.Data(), &dl) != nil || dl.MessageID != "test" {
+		t.Errorf("Dead letter plugin did not receive the dead letter record")
+	}
+}
+
+type mockClosingDeadLetterWriter struct {
+	mockDeadLetterWriter
+	closed chan struct{}
+}
+
+func (m *mockClosingDeadLetterWriter) Close() error {
+	close(m.closed)
+	return nil
+}
+
+func TestThatDeadLetterWriterIsClosedAfterShutdownDeadline(t *testing.T) {
+	rt := NewRuntime(newDefaultConfig())
+	rt.started = true
+	writer := &mockClosingDeadLetterWriter{closed: make(chan struct{})}
+	rt.SetDeadLetterWriter(writer)
+
+	p1 := &wrapper{
+		definition: &mockPluginDef{active: true},
+		implementation: &mockPluginImpl{handled: func() {
+			time.Sleep(50 * time.Millisecond)
+		}},
+	}
+
+	for i := 0; i < 5; i++ {
+		rt.publish(context.Background(), &DefaultDataMessage{id: "test", data: []byte("test")})
+	}
+
+	go rt.consume(func() []*wrapper { return []*wrapper{p1} })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := rt.Shutdown(ctx); err == nil {
+		t.Error("Expected deadline error when shutdown could not drain all messages")
+	}
+
+	select {
+	case <-writer.closed:
+	case <-time.After(time.Second):
+		t.Error("Expected dead letter writer to be closed once consumers stopped")
+	}
+}
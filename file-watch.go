@@ -0,0 +1,337 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"plugin"
+	"strings"
+	"time"
+
+	"github.com/radovskyb/watcher"
+	log "github.com/sirupsen/logrus"
+
+	ouretl "github.com/ourstudio-se/ouretl-abstractions"
+)
+
+// SettingsChangedPlugin can be implemented by any `DataHandlerPlugin` or
+// `WorkerPlugin` to be told when its settings file has changed. The
+// settings passed are the same instance the plugin was created with,
+// which already holds the new values.
+type SettingsChangedPlugin interface {
+	OnSettingsChanged(settings ouretl.PluginSettings)
+}
+
+type fileChangeListenerConfig interface {
+	OnPluginSettingsChanged(func(ouretl.PluginDefinition))
+	OnPluginBinaryChanged(func(ouretl.PluginDefinition))
+}
+
+func notifySettingsChanged(implementation interface{}, pdef ouretl.PluginDefinition) bool {
+	p, ok := implementation.(SettingsChangedPlugin)
+	if !ok {
+		return false
+	}
+
+	p.OnSettingsChanged(pdef.Settings())
+	return true
+}
+
+// fileWatch keeps the checksum of every watched file, since the watcher
+// reports a write whenever the modification time changes, even if the
+// content did not. The directories of include patterns are watched for
+// new files.
+type fileWatch struct {
+	w         *watcher.Watcher
+	checksums map[string]string
+	dirs      map[string]bool
+	unwatched map[string]bool
+	includes  []string
+}
+
+func newFileWatch(w *watcher.Watcher) *fileWatch {
+	return &fileWatch{
+		w:         w,
+		checksums: make(map[string]string),
+		dirs:      make(map[string]bool),
+		unwatched: make(map[string]bool),
+	}
+}
+
+func absolutePath(filePath string) string {
+	if abs, err := filepath.Abs(filePath); err == nil {
+		return abs
+	}
+
+	return filePath
+}
+
+func checksumOf(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (fw *fileWatch) track(filePath string) {
+	if filePath == "" {
+		return
+	}
+
+	filePath = absolutePath(filePath)
+	if _, ok := fw.checksums[filePath]; ok {
+		return
+	}
+
+	checksum, err := checksumOf(filePath)
+	if err != nil {
+		log.Warnf("File '%s' cannot be watched for changes: %v", filePath, err)
+		return
+	}
+
+	if err := fw.w.Add(filePath); err != nil {
+		log.Warnf("File '%s' cannot be watched for changes: %v", filePath, err)
+		return
+	}
+
+	fw.checksums[filePath] = checksum
+}
+
+// trackDir watches the directory of an include pattern for new files.
+// A directory that cannot be watched is reported once, since files added
+// to it are then only read on the next reload of the config, which tries
+// to watch it again.
+func (fw *fileWatch) trackDir(dirPath string) {
+	if fw.dirs[dirPath] {
+		return
+	}
+
+	var err error
+	switch {
+	case strings.ContainsAny(dirPath, "*?["):
+		err = errors.New("only patterns in the last element of a path are watched")
+	case !isDir(dirPath):
+		err = errors.New("it does not exist")
+	default:
+		err = fw.w.Add(dirPath)
+	}
+
+	if err != nil {
+		if !fw.unwatched[dirPath] {
+			log.Warnf("Directory '%s' cannot be watched for new files, they are only read when the config is reloaded: %v", dirPath, err)
+		}
+		fw.unwatched[dirPath] = true
+		return
+	}
+
+	delete(fw.unwatched, dirPath)
+	fw.dirs[dirPath] = true
+}
+
+func (fw *fileWatch) trackIncludes(config *defaultConfig) {
+	fw.includes = config.includes
+	for _, pattern := range config.includes {
+		if isDir(pattern) {
+			fw.trackDir(pattern)
+		} else {
+			fw.trackDir(filepath.Dir(pattern))
+		}
+	}
+
+	for _, filePath := range config.includedFiles {
+		fw.track(filePath)
+	}
+}
+
+func (fw *fileWatch) trackDefinitions(config *defaultConfig) {
+	for _, def := range config.definitions() {
+		fw.track(def.SettingsFileVal)
+		fw.track(def.PathVal)
+	}
+}
+
+// changed tells if the content of a watched file differs from when it
+// was last checked, and remembers the new checksum.
+func (fw *fileWatch) changed(filePath string) bool {
+	checksum, err := checksumOf(filePath)
+	if err != nil || checksum == fw.checksums[filePath] {
+		return false
+	}
+
+	fw.checksums[filePath] = checksum
+	return true
+}
+
+func (fw *fileWatch) forget(filePath string) {
+	delete(fw.checksums, filePath)
+}
+
+// stagedPluginDir is where changed plugin binaries are staged.
+var stagedPluginDir = filepath.Join(os.TempDir(), "ouretl-plugins")
+
+// stagePluginBinary copies a changed plugin binary to a path named by its
+// checksum, since Go returns the already loaded plugin when the same path
+// is opened twice. The copy only loads if the binary was built with a new
+// plugin path, see isPluginAlreadyLoaded, and is removed by openPlugin
+// otherwise. A copy that loaded is kept, since Go opens a loaded plugin
+// again by its path.
+func stagePluginBinary(filePath string) (string, error) {
+	checksum, err := checksumOf(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(stagedPluginDir, 0700); err != nil {
+		return "", err
+	}
+
+	stagedFilePath := filepath.Join(stagedPluginDir, fmt.Sprintf("%s-%s.so", filepath.Base(filePath), checksum[:12]))
+	if err := ioutil.WriteFile(stagedFilePath, content, 0700); err != nil {
+		return "", err
+	}
+
+	return stagedFilePath, nil
+}
+
+type restoreLoadPathDefinition interface {
+	restoreLoadPath(loadPath string)
+}
+
+// openPlugin opens the plugin binary of a definition. A staged copy that
+// fails to load is removed, and the definition goes back to the binary
+// it was loaded from before. The path it was opened from is returned
+// as well.
+func openPlugin(pdef ouretl.PluginDefinition) (*plugin.Plugin, string, error) {
+	filePath := pluginPathFor(pdef)
+	p, err := plugin.Open(filePath)
+	if err == nil || filepath.Dir(filePath) != stagedPluginDir {
+		return p, filePath, err
+	}
+
+	if removeErr := os.Remove(filePath); removeErr != nil && !os.IsNotExist(removeErr) {
+		log.Warnf("Staged plugin binary '%s' could not be removed: %v", filePath, removeErr)
+	}
+	if d, ok := pdef.(restoreLoadPathDefinition); ok {
+		d.restoreLoadPath(filePath)
+	}
+
+	return nil, filePath, err
+}
+
+// isPluginAlreadyLoaded tells if plugin.Open failed because a plugin
+// with the same plugin path is already loaded. Go keys loaded plugins on
+// their plugin path rather than their file, and cannot unload them, so
+// such a binary can only be loaded by restarting the process.
+func isPluginAlreadyLoaded(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "plugin already loaded")
+}
+
+func logPluginOpenError(pdef ouretl.PluginDefinition, filePath string, err error) {
+	if isPluginAlreadyLoaded(err) {
+		log.Errorf("Plugin '%s (v%s)' at path '%s' has the same plugin path as a plugin already loaded -- restart ouretl-core to load it: %v", pdef.Name(), pdef.Version(), filePath, err)
+		return
+	}
+
+	log.Errorf("Plugin '%s (v%s)' could not be found at path '%s': %s", pdef.Name(), pdef.Version(), filePath, err.Error())
+}
+
+// reloadFile applies a change of a settings file or plugin binary to
+// every definition referring to it.
+func (dc *defaultConfig) reloadFile(filePath string) {
+	for _, def := range dc.definitions() {
+		if def.SettingsFileVal != "" && absolutePath(def.SettingsFileVal) == filePath {
+			dc.refreshSettings(def)
+		}
+
+		if def.PathVal != "" && absolutePath(def.PathVal) == filePath {
+			stagedFilePath, err := stagePluginBinary(def.PathVal)
+			if err != nil {
+				log.Errorf("Plugin '%s (v%s)' binary changed, but could not be staged for loading: %v", def.Name(), def.Version(), err)
+				continue
+			}
+
+			def.setLoadPath(stagedFilePath)
+			log.Infof("Plugin '%s (v%s)' binary changed", def.Name(), def.Version())
+
+			dc.notify(&dc.onBinaryChangeListeners, def)
+		}
+	}
+}
+
+// handleFileEvent reloads the config when the config file or any file
+// it includes is changed, added or removed, and otherwise applies the
+// change to the definitions referring to the file.
+func (dc *defaultConfig) handleFileEvent(fw *fileWatch, configFilePath string, event watcher.Event) {
+	if event.FileInfo != nil && event.IsDir() {
+		return
+	}
+
+	included := includesFile(fw.includes, event.Path) || includesFile(fw.includes, event.OldPath)
+	switch {
+	case included && (event.Op == watcher.Remove || event.Op == watcher.Rename):
+		fw.forget(event.Path)
+		fw.forget(event.OldPath)
+	case !fw.changed(event.Path):
+		return
+	}
+
+	if event.Path != configFilePath && !included {
+		dc.reloadFile(event.Path)
+		return
+	}
+
+	nextConfig, err := readConfig(configFilePath, dc.format, dc.strict)
+	if err != nil {
+		log.Errorf("Config file '%s' could not be reloaded: %v", configFilePath, err)
+		return
+	}
+
+	dc.reload(nextConfig)
+	fw.trackIncludes(nextConfig)
+	fw.trackDefinitions(dc)
+}
+
+func (dc *defaultConfig) createFileWatch(configFilePath string) {
+	w := watcher.New()
+	fw := newFileWatch(w)
+	configFilePath = absolutePath(configFilePath)
+
+	fw.track(configFilePath)
+	fw.trackIncludes(dc)
+	fw.trackDefinitions(dc)
+
+	go func() {
+		for {
+			select {
+			case event := <-w.Event:
+				dc.handleFileEvent(fw, configFilePath, event)
+			case err := <-w.Error:
+				log.Warn(err)
+			case <-w.Closed:
+				return
+			}
+		}
+	}()
+
+	if err := w.Start(time.Millisecond * 100); err != nil {
+		log.Error(err)
+	}
+}
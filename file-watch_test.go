@@ -0,0 +1,161 @@
+package core
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/ourstudio-se/ouretl-abstractions"
+	"github.com/radovskyb/watcher"
+)
+
+type mockSettingsChangedPluginImpl struct {
+	mockPluginImpl
+	notified int
+}
+
+func (m *mockSettingsChangedPluginImpl) OnSettingsChanged(_ ouretl.PluginSettings) {
+	m.notified = m.notified + 1
+}
+
+func TestThatFileWatchOnlyReportsChangedContent(t *testing.T) {
+	filePath := "/tmp/settings1.toml"
+	ioutil.WriteFile(filePath, []byte("key = \"value\"\n"), 0600)
+
+	fw := newFileWatch(watcher.New())
+	fw.track(filePath)
+
+	ioutil.WriteFile(filePath, []byte("key = \"value\"\n"), 0600)
+	if fw.changed(filePath) {
+		t.Error("Expected file rewritten with the same content not to be reported as changed")
+	}
+
+	ioutil.WriteFile(filePath, []byte("key = \"other\"\n"), 0600)
+	if !fw.changed(filePath) {
+		t.Error("Expected file with new content to be reported as changed")
+	}
+	if fw.changed(filePath) {
+		t.Error("Expected change to be reported only once")
+	}
+}
+
+func TestThatSettingsFileChangeOnlyNotifiesAffectedPlugin(t *testing.T) {
+	filePath := "/tmp/settings2.toml"
+	ioutil.WriteFile(filePath, []byte("key = \"value\"\n"), 0600)
+
+	config := &defaultConfig{Definitions: []*defaultPluginDefinition{
+		{NameVal: "test-1", VersionVal: "1.0.0", SettingsFileVal: filePath, settings: &defaultPluginSettings{}, isActive: true},
+		{NameVal: "test-2", VersionVal: "1.0.0", settings: &defaultPluginSettings{}, isActive: true},
+	}}
+
+	var changed []string
+	config.OnPluginSettingsChanged(func(pdef ouretl.PluginDefinition) {
+		changed = append(changed, pdef.Name())
+	})
+	binaryChanged := false
+	config.OnPluginBinaryChanged(func(_ ouretl.PluginDefinition) {
+		binaryChanged = true
+	})
+
+	ioutil.WriteFile(filePath, []byte("key = \"changed\"\n"), 0600)
+	config.reloadFile(absolutePath(filePath))
+
+	if value, _ := config.Definitions[0].Settings().Get("key"); value != "changed" {
+		t.Errorf("Expected changed setting to be 'changed', but got '%v'", value)
+	}
+	if len(changed) != 1 || changed[0] != "test-1" {
+		t.Errorf("Expected only plugin 'test-1' to have changed settings, but got %v", changed)
+	}
+	if binaryChanged {
+		t.Error("Expected settings file change not to be reported as a binary change")
+	}
+}
+
+func TestThatPluginBinaryChangeIsStagedAtNewPath(t *testing.T) {
+	filePath := "/tmp/plugin1.so"
+	ioutil.WriteFile(filePath, []byte("binary"), 0700)
+
+	pdef := &defaultPluginDefinition{NameVal: "test-1", VersionVal: "1.0.0", PathVal: filePath, isActive: true}
+	config := &defaultConfig{Definitions: []*defaultPluginDefinition{pdef}}
+
+	called := false
+	config.OnPluginBinaryChanged(func(_ ouretl.PluginDefinition) {
+		called = true
+	})
+
+	config.reloadFile(absolutePath(filePath))
+
+	if !called {
+		t.Error("Expected binary change listener to be called")
+	}
+	if pluginPathFor(pdef) == filePath || pluginPathFor(pdef) == "" {
+		t.Errorf("Expected changed plugin to be loaded from a staged path, but got '%s'", pluginPathFor(pdef))
+	}
+}
+
+func TestThatHandlerIsNotifiedOfChangedSettings(t *testing.T) {
+	impl := &mockSettingsChangedPluginImpl{}
+	w := &wrapper{definition: &defaultPluginDefinition{NameVal: "test-1"}, implementation: impl}
+
+	if !w.notifySettingsChanged() {
+		t.Error("Expected handler implementing `OnSettingsChanged` to be notified")
+	}
+	if impl.notified != 1 {
+		t.Errorf("Expected handler to be notified once, but was notified %d times", impl.notified)
+	}
+
+	other := &wrapper{definition: &defaultPluginDefinition{NameVal: "test-2"}, implementation: &mockPluginImpl{}}
+	if other.notifySettingsChanged() {
+		t.Error("Expected handler without `OnSettingsChanged` not to be notified")
+	}
+}
+
+func TestThatPluginAlreadyLoadedIsDetected(t *testing.T) {
+	if !isPluginAlreadyLoaded(errors.New(`plugin.Open("/tmp/ouretl-writer.so-0123456789ab.so"): plugin already loaded`)) {
+		t.Error("Expected error for a plugin path already loaded to be detected")
+	}
+	if isPluginAlreadyLoaded(errors.New(`plugin.Open("/tmp/missing.so"): realpath failed`)) {
+		t.Error("Expected other errors not to be reported as an already loaded plugin")
+	}
+}
+
+func TestThatStagedBinaryIsRemovedWhenItFailsToLoad(t *testing.T) {
+	filePath := "/tmp/plugin-binary-1.so"
+	ioutil.WriteFile(filePath, []byte("not a plugin"), 0700)
+
+	def := &defaultPluginDefinition{NameVal: "test-1", VersionVal: "1.0.0", PathVal: filePath}
+	stagedFilePath, err := stagePluginBinary(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	def.setLoadPath(stagedFilePath)
+
+	if _, openedFilePath, err := openPlugin(def); err == nil || openedFilePath != stagedFilePath {
+		t.Fatalf("Expected staged binary '%s' to fail to load, but got '%s' (%v)", stagedFilePath, openedFilePath, err)
+	}
+	if _, err := os.Stat(stagedFilePath); !os.IsNotExist(err) {
+		t.Error("Expected staged binary to be removed after failing to load")
+	}
+	if pluginPathFor(def) != filePath {
+		t.Errorf("Expected plugin to be loaded from '%s' again, but got '%s'", filePath, pluginPathFor(def))
+	}
+}
+
+func TestThatMissingIncludeDirectoryIsWatchedOnceCreated(t *testing.T) {
+	dirPath := "/tmp/confd7"
+	os.RemoveAll(dirPath)
+
+	fw := newFileWatch(watcher.New())
+	fw.trackDir(dirPath)
+	fw.trackDir("/tmp/confd*/teams")
+	if fw.dirs[dirPath] || !fw.unwatched[dirPath] || !fw.unwatched["/tmp/confd*/teams"] {
+		t.Fatal("Expected directories that cannot be watched to be reported")
+	}
+
+	os.MkdirAll(dirPath, 0700)
+	fw.trackDir(dirPath)
+	if !fw.dirs[dirPath] || fw.unwatched[dirPath] {
+		t.Error("Expected directory to be watched once it exists")
+	}
+}
@@ -0,0 +1,235 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Formats of config and settings files.
+const (
+	FormatTOML = "toml"
+	FormatYAML = "yaml"
+	FormatJSON = "json"
+)
+
+// formatFor returns the format of a file, which is format if given, and
+// otherwise picked by the extension of the file. Files with any other
+// extension than `.yaml`, `.yml` or `.json` are read as TOML.
+func formatFor(filePath, format string) (string, error) {
+	switch format {
+	case FormatTOML, FormatYAML, FormatJSON:
+		return format, nil
+	case "":
+	default:
+		return "", fmt.Errorf("unknown format '%s', expected one of '%s', '%s' or '%s'", format, FormatTOML, FormatYAML, FormatJSON)
+	}
+
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".yaml", ".yml":
+		return FormatYAML, nil
+	case ".json":
+		return FormatJSON, nil
+	}
+
+	return FormatTOML, nil
+}
+
+// decodeFile decodes a file in the given format into v, and returns the
+// keys in the file that do not match any field of v, named like
+// `plugin.active`.
+func decodeFile(filePath, format string, v interface{}) ([]string, error) {
+	if format == FormatTOML {
+		md, err := toml.DecodeFile(filePath, v)
+		if err != nil {
+			return nil, err
+		}
+
+		var keys []string
+		for _, key := range md.Undecoded() {
+			if !decodedAsValue(reflect.TypeOf(v), key) {
+				keys = append(keys, key.String())
+			}
+		}
+		return keys, nil
+	}
+
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw interface{}
+	if format == FormatYAML {
+		if err := yaml.Unmarshal(content, v); err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(content, &raw); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := decodeJSON(content, v); err != nil {
+			return nil, err
+		}
+		if err := decodeJSON(content, &raw); err != nil {
+			return nil, err
+		}
+	}
+
+	keys := undecodedKeys(normalizeValue(raw), reflect.TypeOf(v), "")
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// decodeJSON keeps numbers as json.Number, so that they can be told
+// apart as integers or floats like in TOML, and tells the line of
+// syntax and type errors.
+func decodeJSON(content []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+
+	err := decoder.Decode(v)
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		return fmt.Errorf("near line %d: %v", lineAt(content, e.Offset), err)
+	case *json.UnmarshalTypeError:
+		return fmt.Errorf("near line %d: %v", lineAt(content, e.Offset), err)
+	}
+
+	return err
+}
+
+func lineAt(content []byte, offset int64) int {
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	}
+
+	return bytes.Count(content[:offset], []byte("\n")) + 1
+}
+
+// normalizeValue turns values decoded from YAML or JSON into the types
+// decoded from TOML: tables are map[string]interface{}, integers are
+// int64 and other numbers float64.
+func normalizeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		table := make(map[string]interface{}, len(v))
+		for k, x := range v {
+			table[fmt.Sprint(k)] = normalizeValue(x)
+		}
+		return table
+	case map[string]interface{}:
+		table := make(map[string]interface{}, len(v))
+		for k, x := range v {
+			table[k] = normalizeValue(x)
+		}
+		return table
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, x := range v {
+			list[i] = normalizeValue(x)
+		}
+		return list
+	case int:
+		return int64(v)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	}
+
+	return value
+}
+
+func normalizeSettings(settings map[string]interface{}) map[string]interface{} {
+	if settings == nil {
+		return nil
+	}
+
+	return normalizeValue(settings).(map[string]interface{})
+}
+
+// undecodedKeys compares a decoded file with the `toml` tags of the
+// struct it was decoded into, which are the same as the `yaml` and
+// `json` tags, and returns the keys that have no matching field.
+func undecodedKeys(raw interface{}, t reflect.Type, prefix string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	var keys []string
+	switch t.Kind() {
+	case reflect.Struct:
+		table, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		for key, value := range table {
+			field, ok := fieldByTag(t, key)
+			if !ok {
+				keys = append(keys, prefix+key)
+				continue
+			}
+			keys = append(keys, undecodedKeys(value, field.Type, prefix+key+".")...)
+		}
+	case reflect.Slice:
+		list, ok := raw.([]interface{})
+		if !ok {
+			return nil
+		}
+
+		for _, value := range list {
+			keys = append(keys, undecodedKeys(value, t.Elem(), prefix)...)
+		}
+	}
+
+	return keys
+}
+
+// decodedAsValue tells if a key reported as undecoded by the TOML
+// decoder is part of a field decoded as a whole, such as a table nested
+// in inline settings.
+func decodedAsValue(t reflect.Type, key []string) bool {
+	for _, name := range key {
+		for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+			t = t.Elem()
+		}
+
+		switch t.Kind() {
+		case reflect.Map, reflect.Interface:
+			return true
+		case reflect.Struct:
+			field, ok := fieldByTag(t, name)
+			if !ok {
+				return false
+			}
+			t = field.Type
+		default:
+			return false
+		}
+	}
+
+	return false
+}
+
+func fieldByTag(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if strings.Split(field.Tag.Get("toml"), ",")[0] == key {
+			return field, true
+		}
+	}
+
+	return reflect.StructField{}, false
+}
@@ -0,0 +1,146 @@
+package core
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestThatYAMLAndJSONConfigEqualsTOMLConfig(t *testing.T) {
+	tomlFilePath := "/tmp/config17.toml"
+	tomlString := "message_timeout = \"5s\"\n\n[[plugin]]\nname = \"router-1\"\nbuiltin = \"router\"\nversion = \"1.0.0\"\npriority = 2\n\n[plugin.settings]\nbatch_size = 10\nratio = 0.5\n\n[plugin.settings.tls]\nenabled = true\n\n[[plugin.rule]]\nroute = \"orders\"\nheader = \"type\"\n"
+	ioutil.WriteFile(tomlFilePath, []byte(tomlString), 0600)
+
+	yamlFilePath := "/tmp/config17.yaml"
+	yamlString := "message_timeout: 5s\nplugin:\n  - name: router-1\n    builtin: router\n    version: 1.0.0\n    priority: 2\n    settings:\n      batch_size: 10\n      ratio: 0.5\n      tls:\n        enabled: true\n    rule:\n      - route: orders\n        header: type\n"
+	ioutil.WriteFile(yamlFilePath, []byte(yamlString), 0600)
+
+	jsonFilePath := "/tmp/config17.json"
+	jsonString := "{\n  \"message_timeout\": \"5s\",\n  \"plugin\": [{\n    \"name\": \"router-1\",\n    \"builtin\": \"router\",\n    \"version\": \"1.0.0\",\n    \"priority\": 2,\n    \"settings\": {\"batch_size\": 10, \"ratio\": 0.5, \"tls\": {\"enabled\": true}},\n    \"rule\": [{\"route\": \"orders\", \"header\": \"type\"}]\n  }]\n}\n"
+	ioutil.WriteFile(jsonFilePath, []byte(jsonString), 0600)
+
+	expected, err := readConfigFromFile(tomlFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, configFilePath := range []string{yamlFilePath, jsonFilePath} {
+		config, err := readConfigFromFile(configFilePath)
+		if err != nil {
+			t.Fatalf("Expected '%s' to be read, but got '%v'", configFilePath, err)
+		}
+
+		if config.MessageTimeout() != 5*time.Second {
+			t.Errorf("Expected message timeout of '%s' to be 5s, but got '%v'", configFilePath, config.MessageTimeout())
+		}
+
+		pdef := config.Definitions[0]
+		if pdef.Name() != "router-1" || pdef.Version() != "1.0.0" || pdef.Priority() != 2 || builtinFor(pdef) != builtinRouter {
+			t.Errorf("Expected plugin of '%s' to equal the TOML plugin, but got '%s'", configFilePath, describe(pdef))
+		}
+		if !reflect.DeepEqual(pdef.inlineSettings(), expected.Definitions[0].inlineSettings()) {
+			t.Errorf("Expected settings of '%s' to equal the TOML settings, but got '%v'", configFilePath, pdef.inlineSettings())
+		}
+		if rules := rulesFor(pdef); len(rules) != 1 || rules[0].Route != "orders" || rules[0].Header != "type" {
+			t.Errorf("Expected rules of '%s' to equal the TOML rules", configFilePath)
+		}
+	}
+}
+
+func TestThatExplicitFormatOverridesExtension(t *testing.T) {
+	configFilePath := "/tmp/config18.conf"
+	ioutil.WriteFile(configFilePath, []byte("plugin:\n  - name: router-1\n    builtin: router\n    version: 1.0.0\n"), 0600)
+
+	if _, err := NewDefaultConfigFromFile(configFilePath, FormatTOML); err == nil {
+		t.Error("Expected YAML config read as TOML to cause an error")
+	}
+
+	config, err := NewDefaultConfigFromFile(configFilePath, FormatYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pdefs := config.PluginDefinitions(); len(pdefs) != 1 || pdefs[0].Name() != "router-1" {
+		t.Errorf("Expected YAML config to have plugin 'router-1', but got '%v'", pdefs)
+	}
+
+	if _, err := NewDefaultConfigFromFile(configFilePath, "xml"); err == nil {
+		t.Error("Expected unknown format to cause an error")
+	}
+}
+
+func TestThatUnknownKeysAreReportedForEveryFormat(t *testing.T) {
+	yamlFilePath := "/tmp/config19.yml"
+	ioutil.WriteFile(yamlFilePath, []byte("plugin:\n  - name: router-1\n    builtin: router\n    version: 1.0.0\n    prioriy: 2\n"), 0600)
+
+	jsonFilePath := "/tmp/config19.json"
+	ioutil.WriteFile(jsonFilePath, []byte("{\"plugin\": [{\"name\": \"router-1\", \"builtin\": \"router\", \"version\": \"1.0.0\", \"prioriy\": 2}]}"), 0600)
+
+	for _, configFilePath := range []string{yamlFilePath, jsonFilePath} {
+		err := ValidateConfigFile(configFilePath, "")
+		ve, ok := err.(*ValidationError)
+		if !ok {
+			t.Fatalf("Expected a validation error for '%s', but got '%v'", configFilePath, err)
+		}
+		if len(ve.Problems) != 1 || ve.Problems[0] != "unknown key 'plugin.prioriy'" {
+			t.Errorf("Expected unknown key 'plugin.prioriy' for '%s', but got '%v'", configFilePath, ve.Problems)
+		}
+	}
+}
+
+func TestThatJSONParseErrorTellsLine(t *testing.T) {
+	configFilePath := "/tmp/config20.json"
+	ioutil.WriteFile(configFilePath, []byte("{\n  \"plugin\": [\n    {\"name\": \"router-1\",}\n  ]\n}\n"), 0600)
+
+	_, err := readConfigFromFile(configFilePath)
+	if err == nil {
+		t.Fatal("Expected invalid JSON config to cause an error")
+	}
+	if !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("Expected error to tell the line, but got '%v'", err)
+	}
+}
+
+func TestThatSettingsFileFormatFollowsExtension(t *testing.T) {
+	yamlFilePath := "/tmp/settings7.yaml"
+	ioutil.WriteFile(yamlFilePath, []byte("endpoint: http://localhost\nbatch_size: 10\ntls:\n  enabled: true\n"), 0600)
+
+	jsonFilePath := "/tmp/settings7.json"
+	ioutil.WriteFile(jsonFilePath, []byte("{\"endpoint\": \"http://localhost\", \"batch_size\": 10, \"tls\": {\"enabled\": true}}"), 0600)
+
+	for _, settingsFilePath := range []string{yamlFilePath, jsonFilePath} {
+		settings, err := readSettingsFromFile(settingsFilePath, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if value, ok := settings.Get("endpoint"); !ok || value != "http://localhost" {
+			t.Errorf("Expected setting 'endpoint' of '%s' to be 'http://localhost', but got '%v'", settingsFilePath, value)
+		}
+		if value, ok := settings.Get("batch_size"); !ok || value != int64(10) {
+			t.Errorf("Expected setting 'batch_size' of '%s' to be 10, but got '%v'", settingsFilePath, value)
+		}
+		if value, ok := settings.Get("tls"); !ok || value.(map[string]interface{})["enabled"] != true {
+			t.Errorf("Expected setting 'tls' of '%s' to be a table, but got '%v'", settingsFilePath, value)
+		}
+	}
+}
+
+func TestThatSettingsFormatOverridesExtension(t *testing.T) {
+	settingsFilePath := "/tmp/settings8.conf"
+	ioutil.WriteFile(settingsFilePath, []byte("endpoint: http://localhost\n"), 0600)
+
+	configFilePath := "/tmp/config21.conf"
+	configString := "[[plugin]]\nname = \"test-1\"\nbuiltin = \"router\"\nversion = \"1.0.0\"\nsettings_file = \"" + settingsFilePath + "\"\nsettings_format = \"yaml\"\n"
+	ioutil.WriteFile(configFilePath, []byte(configString), 0600)
+
+	config, err := readConfigFromFile(configFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value, ok := config.PluginDefinitions()[0].Settings().Get("endpoint"); !ok || value != "http://localhost" {
+		t.Errorf("Expected setting 'endpoint' to be 'http://localhost', but got '%v'", value)
+	}
+}
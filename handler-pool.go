@@ -0,0 +1,186 @@
+package core
+
+import (
+	"sort"
+	"sync"
+
+	ouretl "github.com/ourstudio-se/ouretl-abstractions"
+	log "github.com/sirupsen/logrus"
+)
+
+type changeListenerConfig interface {
+	OnPluginDefinitionChanged(func(ouretl.PluginDefinition))
+}
+
+// handlerPool holds the loaded `DataHandlerPlugin` wrappers in priority
+// order. The wrappers slice is never modified in place; every change
+// swaps in a new slice, so that a message is processed by a consistent
+// snapshot of the pool even while plugins are being reloaded.
+type handlerPool struct {
+	mu       sync.RWMutex
+	wrappers []*wrapper
+	skipped  skippedDefinitions
+}
+
+func (hp *handlerPool) snapshot() []*wrapper {
+	hp.mu.RLock()
+	defer hp.mu.RUnlock()
+
+	return hp.wrappers
+}
+
+// swap replaces the wrapper with the same name and version as w, and
+// every other version of the plugin whose definition is no longer
+// active, i.e. which w replaces after a version change. It returns the
+// retired wrappers.
+func (hp *handlerPool) swap(w *wrapper) []*wrapper {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+
+	var wrappers, retired []*wrapper
+	for _, x := range hp.wrappers {
+		if workerKey(x.definition) == workerKey(w.definition) {
+			retired = append(retired, x)
+			continue
+		}
+		if x.definition.Name() == w.definition.Name() && !x.definition.IsActive() {
+			retired = append(retired, x)
+			continue
+		}
+		wrappers = append(wrappers, x)
+	}
+
+	hp.wrappers = sortedByPriority(append(wrappers, w))
+	return retired
+}
+
+// retire removes the wrapper for a specific name and version, and tells
+// if there was one.
+func (hp *handlerPool) retire(pdef ouretl.PluginDefinition) bool {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+
+	var wrappers []*wrapper
+	for _, x := range hp.wrappers {
+		if x.definition.Name() != pdef.Name() || x.definition.Version() != pdef.Version() {
+			wrappers = append(wrappers, x)
+		}
+	}
+
+	retired := len(wrappers) != len(hp.wrappers)
+	hp.wrappers = wrappers
+	return retired
+}
+
+func (hp *handlerPool) find(pdef ouretl.PluginDefinition) *wrapper {
+	for _, x := range hp.snapshot() {
+		if x.definition.Name() == pdef.Name() && x.definition.Version() == pdef.Version() {
+			return x
+		}
+	}
+
+	return nil
+}
+
+func (hp *handlerPool) contains(pdef ouretl.PluginDefinition) bool {
+	return hp.find(pdef) != nil
+}
+
+func (hp *handlerPool) resort() {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+
+	hp.wrappers = sortedByPriority(append([]*wrapper(nil), hp.wrappers...))
+}
+
+func (hp *handlerPool) load(pdef ouretl.PluginDefinition, config ouretl.Config) {
+	w := NewHandler(pdef, config)
+	if w == nil {
+		hp.skipped.add(pdef, isHandlerPlugin)
+		return
+	}
+
+	for _, r := range hp.swap(w) {
+		if r.definition.Version() == pdef.Version() {
+			log.Infof("`DataHandlerPlugin` '%s (v%s)' reloaded", pdef.Name(), pdef.Version())
+			continue
+		}
+		log.Infof("`DataHandlerPlugin` '%s (v%s)' retired, replaced by v%s", r.definition.Name(), r.definition.Version(), pdef.Version())
+	}
+
+	log.Infof("`DataHandlerPlugin` '%s (v%s)' added, a total of %d `DataHandlerPlugin` implementations loaded", pdef.Name(), pdef.Version(), len(hp.snapshot()))
+}
+
+func sortedByPriority(wrappers []*wrapper) []*wrapper {
+	sort.SliceStable(wrappers, func(i, j int) bool {
+		return wrappers[i].definition.Priority() < wrappers[j].definition.Priority()
+	})
+
+	return wrappers
+}
+
+// newHandlerPoolFromConfig loads all handlers in the config, and keeps
+// the pool in sync with it: added or activated definitions are loaded,
+// replacing the version of the same plugin they take the place of,
+// deactivated definitions are retired, and priority changes reorder the
+// pool. A handler skipped because of invalid settings is loaded once
+// its settings change.
+func newHandlerPoolFromConfig(config ouretl.Config) func() []*wrapper {
+	pool := &handlerPool{wrappers: sortedByPriority(NewHandlerPool(config))}
+	for _, pdef := range config.PluginDefinitions() {
+		if pdef.IsActive() && !pool.contains(pdef) {
+			pool.skipped.add(pdef, isHandlerPlugin)
+		}
+	}
+
+	config.OnPluginDefinitionAdded(func(pdef ouretl.PluginDefinition) {
+		if pdef.IsActive() {
+			pool.load(pdef, config)
+		}
+	})
+
+	config.OnPluginDefinitionActivated(func(pdef ouretl.PluginDefinition) {
+		if !pool.contains(pdef) {
+			pool.load(pdef, config)
+		}
+	})
+
+	config.OnPluginDefinitionDeactivated(func(pdef ouretl.PluginDefinition) {
+		if pool.retire(pdef) {
+			log.Infof("`DataHandlerPlugin` '%s (v%s)' retired, a total of %d `DataHandlerPlugin` implementations loaded", pdef.Name(), pdef.Version(), len(pool.snapshot()))
+		}
+	})
+
+	if c, ok := config.(changeListenerConfig); ok {
+		c.OnPluginDefinitionChanged(func(pdef ouretl.PluginDefinition) {
+			pool.resort()
+			log.Infof("`DataHandlerPlugin` '%s (v%s)' changed priority to %d", pdef.Name(), pdef.Version(), pdef.Priority())
+		})
+	}
+
+	if c, ok := config.(fileChangeListenerConfig); ok {
+		c.OnPluginSettingsChanged(func(pdef ouretl.PluginDefinition) {
+			w := pool.find(pdef)
+			if w == nil {
+				if pdef.IsActive() && pool.skipped.retry(pdef) {
+					pool.load(pdef, config)
+				}
+				return
+			}
+
+			if w.notifySettingsChanged() {
+				log.Infof("`DataHandlerPlugin` '%s (v%s)' notified of changed settings", pdef.Name(), pdef.Version())
+			}
+		})
+
+		c.OnPluginBinaryChanged(func(pdef ouretl.PluginDefinition) {
+			if pdef.IsActive() {
+				pool.load(pdef, config)
+			}
+		})
+	}
+
+	log.Infof("%d `DataHandlerPlugin` implementations loaded", len(pool.snapshot()))
+
+	return pool.snapshot
+}
@@ -0,0 +1,146 @@
+package core
+
+import (
+	"testing"
+
+	ouretl "github.com/ourstudio-se/ouretl-abstractions"
+)
+
+func newVersionedWrapper(name, version string, priority int) *wrapper {
+	return &wrapper{
+		definition:     &defaultPluginDefinition{NameVal: name, VersionVal: version, PriorityVal: priority, isActive: true},
+		implementation: &mockPluginImpl{handled: func() {}},
+	}
+}
+
+func TestThatNewVersionReplacesOldWrapper(t *testing.T) {
+	replaced := newVersionedWrapper("transform", "1.0.0", 1)
+	replaced.definition.(*defaultPluginDefinition).setActive(false)
+	pool := &handlerPool{wrappers: []*wrapper{
+		replaced,
+		newVersionedWrapper("writer", "1.0.0", 2),
+	}}
+	before := pool.snapshot()
+
+	retired := pool.swap(newVersionedWrapper("transform", "1.1.0", 1))
+
+	if len(retired) != 1 || retired[0].definition.Version() != "1.0.0" {
+		t.Errorf("Expected old version to be retired, got %d retired wrappers", len(retired))
+	}
+
+	after := pool.snapshot()
+	if len(after) != 2 || after[0].definition.Version() != "1.1.0" {
+		t.Errorf("Expected new version to take the place of the old one, got %d wrappers", len(after))
+	}
+	if before[0].definition.Version() != "1.0.0" {
+		t.Error("Snapshot taken before the swap was modified")
+	}
+}
+
+func TestThatSwapKeepsOtherActiveVersions(t *testing.T) {
+	pool := &handlerPool{wrappers: []*wrapper{
+		newVersionedWrapper("transform", "1.0.0", 1),
+		newVersionedWrapper("transform", "2.0.0", 2),
+	}}
+
+	retired := pool.swap(newVersionedWrapper("transform", "2.0.0", 2))
+
+	if len(retired) != 1 || retired[0].definition.Version() != "2.0.0" {
+		t.Errorf("Expected only the reloaded version to be retired, got %d retired wrappers", len(retired))
+	}
+
+	after := pool.snapshot()
+	if len(after) != 2 || after[0].definition.Version() != "1.0.0" || after[1].definition.Version() != "2.0.0" {
+		t.Errorf("Expected both versions to stay loaded, got %d wrappers", len(after))
+	}
+}
+
+func TestThatReloadSwapsVersionInHandlerPool(t *testing.T) {
+	config := newDefaultConfig().(*defaultConfig)
+	_ = config.AppendPluginDefinition(&defaultPluginDefinition{NameVal: "router", VersionVal: "1.0.0", BuiltinVal: builtinRouter, isActive: true})
+	pool := newHandlerPoolFromConfig(config)
+
+	var seen [][]*wrapper
+	config.OnPluginDefinitionAdded(func(ouretl.PluginDefinition) {
+		seen = append(seen, pool())
+	})
+
+	nextConfig := &defaultConfig{Definitions: []*defaultPluginDefinition{
+		{NameVal: "router", VersionVal: "1.1.0", BuiltinVal: builtinRouter, isActive: true},
+	}}
+	config.reload(nextConfig)
+
+	if len(seen) != 1 || len(seen[0]) != 1 || seen[0][0].definition.Version() != "1.1.0" {
+		t.Error("Expected version 1.1.0 to replace version 1.0.0 as soon as it was added")
+	}
+	if after := pool(); len(after) != 1 || after[0].definition.Version() != "1.1.0" {
+		t.Errorf("Expected only version 1.1.0 to be loaded, got %d wrappers", len(after))
+	}
+}
+
+func TestThatDeactivatedWrapperIsRetired(t *testing.T) {
+	pool := &handlerPool{wrappers: []*wrapper{
+		newVersionedWrapper("transform", "1.0.0", 1),
+		newVersionedWrapper("writer", "1.0.0", 2),
+	}}
+
+	if !pool.retire(&defaultPluginDefinition{NameVal: "transform", VersionVal: "1.0.0"}) {
+		t.Error("Existing wrapper was not retired")
+	}
+	if pool.retire(&defaultPluginDefinition{NameVal: "transform", VersionVal: "1.0.0"}) {
+		t.Error("Wrapper was retired twice")
+	}
+	if len(pool.snapshot()) != 1 {
+		t.Errorf("Expected 1 wrapper after retiring, got %d", len(pool.snapshot()))
+	}
+}
+
+func TestThatReloadReportsPriorityChanges(t *testing.T) {
+	config := newDefaultConfig().(*defaultConfig)
+	_ = config.AppendPluginDefinition(&defaultPluginDefinition{NameVal: "transform", VersionVal: "1.0.0", PriorityVal: 1, isActive: true})
+	_ = config.AppendPluginDefinition(&defaultPluginDefinition{NameVal: "writer", VersionVal: "1.0.0", PriorityVal: 2, isActive: true})
+
+	var changed []ouretl.PluginDefinition
+	config.OnPluginDefinitionChanged(func(pdef ouretl.PluginDefinition) {
+		changed = append(changed, pdef)
+	})
+
+	nextConfig := &defaultConfig{Definitions: []*defaultPluginDefinition{
+		{NameVal: "transform", VersionVal: "1.0.0", PriorityVal: 3, isActive: true},
+		{NameVal: "writer", VersionVal: "1.0.0", PriorityVal: 2, isActive: true},
+	}}
+	config.reload(nextConfig)
+
+	if len(changed) != 1 || changed[0].Name() != "transform" || changed[0].Priority() != 3 {
+		t.Errorf("Expected a priority change for 'transform', got %d changes", len(changed))
+	}
+	if config.PluginDefinitions()[0].Name() != "writer" {
+		t.Error("Config was not reordered after priority change")
+	}
+}
+
+func TestThatReloadDeactivatesOldVersionAndAddsNewVersion(t *testing.T) {
+	config := newDefaultConfig().(*defaultConfig)
+	_ = config.AppendPluginDefinition(&defaultPluginDefinition{NameVal: "transform", VersionVal: "1.0.0", PriorityVal: 1, isActive: true})
+
+	stored := config.PluginDefinitions()[0]
+	var added, deactivated []ouretl.PluginDefinition
+	config.OnPluginDefinitionAdded(func(pdef ouretl.PluginDefinition) {
+		added = append(added, pdef)
+	})
+	config.OnPluginDefinitionDeactivated(func(pdef ouretl.PluginDefinition) {
+		deactivated = append(deactivated, pdef)
+	})
+
+	nextConfig := &defaultConfig{Definitions: []*defaultPluginDefinition{
+		{NameVal: "transform", VersionVal: "1.1.0", PriorityVal: 1, isActive: true},
+	}}
+	config.reload(nextConfig)
+
+	if len(added) != 1 || added[0].Version() != "1.1.0" {
+		t.Errorf("Expected version 1.1.0 to be added, got %d added definitions", len(added))
+	}
+	if len(deactivated) != 1 || deactivated[0] != stored || stored.IsActive() {
+		t.Error("Expected the stored definition of version 1.0.0 to be deactivated")
+	}
+}
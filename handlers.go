@@ -1,25 +1,81 @@
 package core
 
 import (
+	"context"
+	"errors"
 	"plugin"
+	"sync/atomic"
 	"time"
 
 	ouretl "github.com/ourstudio-se/ouretl-abstractions"
 	log "github.com/sirupsen/logrus"
 )
 
+// ContextDataHandlerPlugin is a context aware variant of
+// ouretl.DataHandlerPlugin. A plugin opts in by exposing a
+// `GetHandlerWithContext` symbol instead of `GetHandler`:
+//
+//	func GetHandlerWithContext(_ ouretl.Config, _ ouretl.PluginSettings) (core.ContextDataHandlerPlugin, error)
+//
+// The context is cancelled when the message exceeds its processing
+// timeout, or when the runtime is forced to stop during shutdown.
+type ContextDataHandlerPlugin interface {
+	Handle(ctx context.Context, dm ouretl.DataMessage, next func(context.Context, []byte) error) error
+}
+
 type wrapper struct {
-	definition     ouretl.PluginDefinition
-	implementation ouretl.DataHandlerPlugin
+	definition            ouretl.PluginDefinition
+	implementation        ouretl.DataHandlerPlugin
+	contextImplementation ContextDataHandlerPlugin
+}
+
+func (w *wrapper) handle(ctx context.Context, dm ouretl.DataMessage, next func(context.Context, []byte) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if w.contextImplementation != nil {
+		return w.contextImplementation.Handle(ctx, dm, next)
+	}
+
+	return w.implementation.Handle(dm, func(data []byte) error {
+		return next(ctx, data)
+	})
+}
+
+func (w *wrapper) notifySettingsChanged() bool {
+	if w.contextImplementation != nil {
+		return notifySettingsChanged(w.contextImplementation, w.definition)
+	}
+
+	return notifySettingsChanged(w.implementation, w.definition)
 }
 
 func NewHandler(definition ouretl.PluginDefinition, config ouretl.Config) *wrapper {
-	p, err := plugin.Open(definition.FilePath())
+	if err := settingsErrorFor(definition); err != nil {
+		log.Errorf("Plugin '%s (v%s)' has invalid settings -- it will be excluded from messaging pipeline: %v", definition.Name(), definition.Version(), err)
+		return nil
+	}
+
+	if builtinFor(definition) != "" {
+		return newBuiltinHandler(definition)
+	}
+
+	p, filePath, err := openPlugin(definition)
 	if err != nil {
-		log.Errorf("Plugin '%s (v%s)' could not be found at path '%s': %s", definition.Name(), definition.Version(), definition.FilePath(), err.Error())
+		logPluginOpenError(definition, filePath, err)
+		return nil
+	}
+
+	if err := validateSettingsSchema(p, definition); err != nil {
+		log.Errorf("Plugin '%s (v%s)' settings do not match its schema -- it will be excluded from messaging pipeline: %v", definition.Name(), definition.Version(), err)
 		return nil
 	}
 
+	if actor, err := p.Lookup("GetHandlerWithContext"); err == nil {
+		return newContextHandler(actor, definition, config)
+	}
+
 	actor, err := p.Lookup("GetHandler")
 	if err != nil {
 		log.Debugf("Plugin '%s (v%s)' did not expose a `GetHandler` symbol -- it will be excluded from messaging pipeline", definition.Name(), definition.Version())
@@ -46,6 +102,54 @@ func NewHandler(definition ouretl.PluginDefinition, config ouretl.Config) *wrapp
 	}
 }
 
+// isHandlerPlugin tells if a definition refers to a built-in or a
+// plugin exposing a `DataHandlerPlugin`, without loading it.
+func isHandlerPlugin(definition ouretl.PluginDefinition) bool {
+	if builtinFor(definition) != "" {
+		return true
+	}
+
+	return exposesSymbol(definition, "GetHandlerWithContext", "GetHandler")
+}
+
+// exposesSymbol tells if the plugin of a definition exposes any of the
+// given symbols.
+func exposesSymbol(definition ouretl.PluginDefinition, symbols ...string) bool {
+	p, _, err := openPlugin(definition)
+	if err != nil {
+		return false
+	}
+
+	for _, symbol := range symbols {
+		if _, err := p.Lookup(symbol); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+func newContextHandler(actor plugin.Symbol, definition ouretl.PluginDefinition, config ouretl.Config) *wrapper {
+	retriever, ok := actor.(func(ouretl.Config, ouretl.PluginSettings) (ContextDataHandlerPlugin, error))
+	if !ok {
+		log.Errorf("Plugin '%s (v%s)' was loaded as a `ContextDataHandlerPlugin`, but does not expose a valid function declaration -- it will be excluded from messaging pipeline", definition.Name(), definition.Version())
+		return nil
+	}
+
+	handler, err := retriever(config, definition.Settings())
+	if err != nil {
+		log.Errorf("Plugin '%s (v%s)' could not be loaded as a `ContextDataHandlerPlugin`, received error: %v", definition.Name(), definition.Version(), err)
+		return nil
+	}
+
+	log.Infof("Plugin '%s (v%s)' successfully loaded as a `ContextDataHandlerPlugin`", definition.Name(), definition.Version())
+
+	return &wrapper{
+		definition:            definition,
+		contextImplementation: handler,
+	}
+}
+
 func NewHandlerPool(config ouretl.Config) []*wrapper {
 	var pool []*wrapper
 	for _, definition := range config.PluginDefinitions() {
@@ -60,33 +164,42 @@ func NewHandlerPool(config ouretl.Config) []*wrapper {
 	return pool
 }
 
+// NewHandlerPoolFromConfig is the legacy serial loop, which handles the
+// messages read from channel one at a time, in the order they arrive.
+// It does not apply `message_timeout`, `concurrency`,
+// `preserve_origin_order` or dead letters, and an invalid pipeline is
+// logged and replaced by a chain in priority order instead of failing.
+//
+// Deprecated: Use NewRuntime, which applies the full config.
 func NewHandlerPoolFromConfig(channel <-chan *DefaultDataMessage, config ouretl.Config) {
-	pool := NewHandlerPool(config)
-
-	config.OnPluginDefinitionAdded(func(pdef ouretl.PluginDefinition) {
-		wrapper := NewHandler(pdef, config)
-		if wrapper != nil {
-			pool = append(pool, wrapper)
-			log.Infof("`DataHandlerPlugin` '%s (v%s)' added, a total of %d `DataHandlerPlugin` implementations loaded", pdef.Name(), pdef.Version(), len(pool))
-		}
-	})
+	pool := newHandlerPoolFromConfig(config)
 
-	log.Infof("%d `DataHandlerPlugin` implementations loaded", len(pool))
+	p, err := pipelineFromConfig(config)
+	if err != nil {
+		log.Errorf("Pipeline could not be built from config, falling back to a chain in priority order: %v", err)
+	}
 
 	for {
 		select {
 		case msg := <-channel:
-			proxyDataMessage(pool, msg)
+			if p == nil {
+				proxyDataMessage(context.Background(), pool(), msg)
+				continue
+			}
+
+			if err := p.process(context.Background(), pool(), msg, func(error) {}); err != nil {
+				log.Error(err)
+			}
 		}
 	}
 }
 
-func proxyDataMessage(pool []*wrapper, dm *DefaultDataMessage) {
+func proxyDataMessage(ctx context.Context, pool []*wrapper, dm *DefaultDataMessage) error {
 	log.Debugf("Processing a new message with ID '%s', initiated from worker '%s'", dm.ID(), dm.Origin())
 	startedAt := time.Now()
 
 	counter := 0
-	caller := func(data []byte) error {
+	var caller chainFunc = func(_ context.Context, _ *DefaultDataMessage, _ []byte) error {
 		ms := int64(time.Since(startedAt) / time.Millisecond)
 		log.Debugf("Message with ID '%s' processed by %d DataHandlerPlugin implementations in %d ms", dm.ID(), counter, ms)
 
@@ -99,20 +212,52 @@ func proxyDataMessage(pool []*wrapper, dm *DefaultDataMessage) {
 		}
 
 		counter = counter + 1
-		next := newDataFunc(pool[i], dm, caller)
+		next := newDataFunc(pool[i], caller)
 		caller = next
 	}
 
-	err := caller(dm.Data())
+	err := caller(ctx, dm, dm.Data())
 	if err != nil {
 		log.Error(err)
 	}
+
+	return err
 }
 
-func newDataFunc(w *wrapper, dm *DefaultDataMessage, fn func([]byte) error) func(data []byte) error {
-	return func(data []byte) error {
-		log.Debugf("DataHandlerPlugin '%s (v%s)' receiving message with ID '%s'", w.definition.Name(), w.definition.Version(), dm.ID())
-		return w.implementation.Handle(dm.withData(data), fn)
+// chainFunc is a step in a chain of handlers, called with the message
+// received by the previous handler and the data it passed on, so that
+// each handler receives its own copy of the message derived from the
+// one its predecessor received.
+type chainFunc func(ctx context.Context, previous *DefaultDataMessage, data []byte) error
+
+func newDataFunc(w *wrapper, fn chainFunc) chainFunc {
+	return func(ctx context.Context, previous *DefaultDataMessage, data []byte) error {
+		if !acceptsMessage(w.definition, previous) {
+			log.Debugf("DataHandlerPlugin '%s (v%s)' does not accept message with ID '%s', skipping it", w.definition.Name(), w.definition.Version(), previous.ID())
+			return fn(ctx, previous, data)
+		}
+
+		log.Debugf("DataHandlerPlugin '%s (v%s)' receiving message with ID '%s'", w.definition.Name(), w.definition.Version(), previous.ID())
+
+		var forwarded int32
+		var step *DefaultDataMessage
+		err := withRetry(ctx, retryPolicyFor(w.definition), w, previous, func() bool {
+			return atomic.LoadInt32(&forwarded) == 1
+		}, func() error {
+			current := previous.withData(data)
+			step = current
+			return w.handle(ctx, current, func(ctx context.Context, data []byte) error {
+				atomic.StoreInt32(&forwarded, 1)
+				return fn(ctx, current, data)
+			})
+		})
+
+		var he *handlerError
+		if err != nil && !errors.As(err, &he) {
+			return &handlerError{definition: w.definition, message: step, err: err}
+		}
+
+		return err
 	}
 }
 
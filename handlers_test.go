@@ -1,6 +1,7 @@
 package core
 
 import (
+	"context"
 	"sync"
 	"testing"
 
@@ -8,7 +9,8 @@ import (
 )
 
 type mockPluginDef struct {
-	active bool
+	active   bool
+	settings ouretl.PluginSettings
 }
 
 func (m *mockPluginDef) Name() string {
@@ -32,7 +34,7 @@ func (m *mockPluginDef) IsActive() bool {
 }
 
 func (m *mockPluginDef) Settings() ouretl.PluginSettings {
-	return nil
+	return m.settings
 }
 
 type mockPluginImpl struct {
@@ -78,7 +80,7 @@ func TestThatPushedMessageReachesActiveHandlersInPipeline(t *testing.T) {
 	pool = append(pool, p1)
 	pool = append(pool, p2)
 	pool = append(pool, p3)
-	proxyDataMessage(pool, &DefaultDataMessage{id: "test", data: []byte("test")})
+	proxyDataMessage(context.Background(), pool, &DefaultDataMessage{id: "test", data: []byte("test")})
 
 	wg.Wait()
 
@@ -125,7 +127,7 @@ func TestThatPushedMessageDoesntReachInactiveHandlersInPipeline(t *testing.T) {
 	pool = append(pool, p1)
 	pool = append(pool, p2)
 	pool = append(pool, p3)
-	proxyDataMessage(pool, &DefaultDataMessage{id: "test", data: []byte("test")})
+	proxyDataMessage(context.Background(), pool, &DefaultDataMessage{id: "test", data: []byte("test")})
 
 	wg.Wait()
 
@@ -139,3 +141,184 @@ func TestThatPushedMessageDoesntReachInactiveHandlersInPipeline(t *testing.T) {
 		t.Error("Third data handler wasn't called")
 	}
 }
+
+type mockContextPluginImpl struct {
+	called bool
+	ctx    context.Context
+}
+
+func (m *mockContextPluginImpl) Handle(ctx context.Context, dm ouretl.DataMessage, next func(context.Context, []byte) error) error {
+	m.called = true
+	m.ctx = ctx
+	return next(ctx, dm.Data())
+}
+
+func TestThatContextIsPropagatedThroughPipeline(t *testing.T) {
+	type ctxKey struct{}
+	ctx := context.WithValue(context.Background(), ctxKey{}, "value")
+
+	p1i := &mockPluginImpl{handled: func() {}}
+	p1 := &wrapper{
+		definition:     &mockPluginDef{active: true},
+		implementation: p1i,
+	}
+	p2i := &mockContextPluginImpl{}
+	p2 := &wrapper{
+		definition:            &mockPluginDef{active: true},
+		contextImplementation: p2i,
+	}
+
+	proxyDataMessage(ctx, []*wrapper{p1, p2}, &DefaultDataMessage{id: "test", data: []byte("test")})
+
+	if !p1i.called {
+		t.Error("First data handler wasn't called")
+	}
+	if !p2i.called {
+		t.Error("Second data handler wasn't called")
+	}
+	if p2i.ctx == nil || p2i.ctx.Value(ctxKey{}) != "value" {
+		t.Error("Context was not propagated to context aware data handler")
+	}
+}
+
+func TestThatCancelledContextStopsPipeline(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	p1i := &mockContextPluginImpl{}
+	p1 := &wrapper{
+		definition:            &mockPluginDef{active: true},
+		contextImplementation: p1i,
+	}
+
+	proxyDataMessage(ctx, []*wrapper{p1}, &DefaultDataMessage{id: "test", data: []byte("test")})
+
+	if p1i.called {
+		t.Error("Data handler was called despite a cancelled context")
+	}
+}
+
+type mockHeaderPluginImpl struct {
+	key   string
+	value string
+	seen  map[string]string
+}
+
+func (m *mockHeaderPluginImpl) Handle(dm ouretl.DataMessage, next func([]byte) error) error {
+	hdm := dm.(HeaderedDataMessage)
+	m.seen = hdm.Headers()
+	if m.key != "" {
+		hdm.SetHeader(m.key, m.value)
+	}
+
+	return next(append(dm.Data(), '!'))
+}
+
+func TestThatHeadersFromWorkerReachHandlersInPipeline(t *testing.T) {
+	var published *DefaultDataMessage
+	proxy := newMessageProxy(func(_ context.Context, dm *DefaultDataMessage) {
+		published = dm
+	}, "worker", "")
+	proxy(context.Background(), []byte("test"), map[string]string{"content-type": "application/json"})
+
+	p1i := &mockHeaderPluginImpl{key: "tenant", value: "ourstudio"}
+	p1 := &wrapper{
+		definition:     &mockPluginDef{active: true},
+		implementation: p1i,
+	}
+	p2i := &mockHeaderPluginImpl{}
+	p2 := &wrapper{
+		definition:     &mockPluginDef{active: true},
+		implementation: p2i,
+	}
+
+	_ = proxyDataMessage(context.Background(), []*wrapper{p1, p2}, published)
+
+	if p1i.seen["content-type"] != "application/json" {
+		t.Error("Header set by worker did not reach first data handler")
+	}
+	if p2i.seen["content-type"] != "application/json" || p2i.seen["tenant"] != "ourstudio" {
+		t.Errorf("Headers were not preserved along the pipeline, got %v", p2i.seen)
+	}
+}
+
+func TestThatEachHandlerReceivesItsOwnMessage(t *testing.T) {
+	var first, second ouretl.DataMessage
+	p1 := &wrapper{
+		definition: &mockPluginDef{active: true},
+		implementation: &mockDataRecorder{record: func(dm ouretl.DataMessage) {
+			first = dm
+		}},
+	}
+	p2 := &wrapper{
+		definition:     &mockPluginDef{active: true},
+		implementation: &mockTransformPluginImpl{},
+	}
+	p3 := &wrapper{
+		definition: &mockPluginDef{active: true},
+		implementation: &mockDataRecorder{record: func(dm ouretl.DataMessage) {
+			second = dm
+		}},
+	}
+
+	_ = proxyDataMessage(context.Background(), []*wrapper{p1, p2, p3}, &DefaultDataMessage{id: "test", data: []byte("test")})
+
+	if string(first.Data()) != "test" {
+		t.Errorf("Message held by first data handler was changed to '%s' by a later handler", string(first.Data()))
+	}
+	if string(second.Data()) != "test-transformed" {
+		t.Errorf("Expected transformed data '%s' but got '%s'", "test-transformed", string(second.Data()))
+	}
+	if string(second.(AuditableDataMessage).OriginalData()) != "test" {
+		t.Errorf("Expected original data '%s' but got '%s'", "test", string(second.(AuditableDataMessage).OriginalData()))
+	}
+}
+
+type mockSplitterPluginImpl struct {
+	parts []string
+	seen  []ouretl.DataMessage
+}
+
+func (m *mockSplitterPluginImpl) Handle(dm ouretl.DataMessage, next func([]byte) error) error {
+	for _, part := range m.parts {
+		m.seen = append(m.seen, dm)
+		if err := next([]byte(part)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func TestThatHandlerKeepsItsMessageWhileLaterHandlersChangeData(t *testing.T) {
+	p1i := &mockSplitterPluginImpl{parts: []string{"a", "b"}}
+	p1 := &wrapper{
+		definition:     &mockPluginDef{active: true},
+		implementation: p1i,
+	}
+	p2 := &wrapper{
+		definition:     &mockPluginDef{active: true},
+		implementation: &mockHeaderPluginImpl{key: "tenant", value: "ourstudio"},
+	}
+	var received []ouretl.DataMessage
+	p3 := &wrapper{
+		definition: &mockPluginDef{active: true},
+		implementation: &mockDataRecorder{record: func(dm ouretl.DataMessage) {
+			received = append(received, dm)
+		}},
+	}
+
+	_ = proxyDataMessage(context.Background(), []*wrapper{p1, p2, p3}, &DefaultDataMessage{id: "test", data: []byte("test")})
+
+	for _, dm := range p1i.seen {
+		if string(dm.Data()) != "test" {
+			t.Errorf("Message held by splitting data handler was changed to '%s' by a later handler", string(dm.Data()))
+		}
+	}
+	if len(received) != 2 || string(received[0].Data()) != "a!" || string(received[1].Data()) != "b!" {
+		t.Fatalf("Expected both parts to reach the last data handler, got %v", received)
+	}
+	if _, ok := p2.implementation.(*mockHeaderPluginImpl).seen["tenant"]; ok {
+		t.Error("Second part was derived from a message of a later handler instead of the splitting one")
+	}
+}
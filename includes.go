@@ -0,0 +1,258 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// includedConfig holds the keys an included config file may declare.
+// Any other key, including `include`, is reported as unknown.
+type includedConfig struct {
+	Stages      []*stageDefinition         `toml:"stage" json:"stage" yaml:"stage"`
+	Definitions []*defaultPluginDefinition `toml:"plugin" json:"plugin" yaml:"plugin"`
+}
+
+// includeExtensions are the files read from an included directory.
+var includeExtensions = map[string]bool{
+	".toml": true,
+	".conf": true,
+	".yaml": true,
+	".yml":  true,
+	".json": true,
+}
+
+func isDir(filePath string) bool {
+	info, err := os.Stat(filePath)
+	return err == nil && info.IsDir()
+}
+
+// includePatternsFor returns the include patterns of a config file as
+// absolute paths, where relative patterns are relative to the directory
+// of the config file.
+func includePatternsFor(configFilePath string, includes []string) []string {
+	var patterns []string
+	for _, include := range includes {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(absolutePath(configFilePath)), include)
+		}
+		patterns = append(patterns, filepath.Clean(include))
+	}
+
+	return patterns
+}
+
+// includeMatches tells if a file is included by a pattern, which is
+// either a glob or a directory.
+func includeMatches(pattern string, filePath string) bool {
+	if filePath == "" {
+		return false
+	}
+
+	if isDir(pattern) {
+		return filepath.Dir(filePath) == pattern && includeExtensions[strings.ToLower(filepath.Ext(filePath))]
+	}
+
+	ok, _ := filepath.Match(pattern, filePath)
+	return ok
+}
+
+func includesFile(patterns []string, filePath string) bool {
+	for _, pattern := range patterns {
+		if includeMatches(pattern, filePath) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// expandInclude returns the files included by a pattern, sorted by
+// name. A pattern matching no file is not an error, so that an empty
+// conf.d directory can be included.
+func expandInclude(pattern string) ([]string, error) {
+	var files []string
+	if isDir(pattern) {
+		infos, err := ioutil.ReadDir(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, info := range infos {
+			filePath := filepath.Join(pattern, info.Name())
+			if !info.IsDir() && includeMatches(pattern, filePath) {
+				files = append(files, filePath)
+			}
+		}
+	} else {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, filePath := range matches {
+			if !isDir(filePath) {
+				files = append(files, filePath)
+			}
+		}
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+// includeFiles returns every file included by a config file, in the
+// order of its patterns. A file matched by more than one pattern is
+// only included at its first match, and the config file itself is
+// never included.
+func includeFiles(configFilePath string, patterns []string) ([]string, []string) {
+	var files []string
+	var problems []string
+
+	seen := map[string]bool{absolutePath(configFilePath): true}
+	for _, pattern := range patterns {
+		matches, err := expandInclude(pattern)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("include '%s' cannot be read: %v", pattern, err))
+			continue
+		}
+
+		for _, filePath := range matches {
+			if !seen[filePath] {
+				seen[filePath] = true
+				files = append(files, filePath)
+			}
+		}
+	}
+
+	return files, problems
+}
+
+// mergeIncludes reads the files included by the config, and merges
+// their plugins and stages into it, in order. A plugin declared with
+// the same name and version as one in an earlier file replaces it in
+// its place, as does a stage with the same name. If the earlier file
+// declared it more than once, every copy is replaced by the one in
+// place of the first. Declaring the same plugin twice within one file
+// is still reported as a problem. Relative paths in an included file
+// are relative to its directory.
+func (dc *defaultConfig) mergeIncludes(configFilePath string) []string {
+	dc.includes = includePatternsFor(configFilePath, dc.IncludeVal)
+
+	files, problems := includeFiles(configFilePath, dc.includes)
+	dc.includedFiles = files
+
+	pluginOrigins := make(map[string]string)
+	for _, def := range dc.Definitions {
+		pluginOrigins[workerKey(def)] = configFilePath
+	}
+	stageOrigins := make(map[string]string)
+	for _, stage := range dc.Stages {
+		stageOrigins[stage.Name] = configFilePath
+	}
+
+	for _, filePath := range files {
+		format, err := formatFor(filePath, "")
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("included file '%s' cannot be read: %v", filePath, err))
+			continue
+		}
+
+		var included includedConfig
+		undecoded, err := decodeFile(filePath, format, &included)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("included file '%s' cannot be read: %v", filePath, err))
+			continue
+		}
+		for _, key := range undecoded {
+			problems = append(problems, fmt.Sprintf("included file '%s' has unknown key '%s'", filePath, key))
+		}
+		for _, problem := range interpolate(&included) {
+			problems = append(problems, fmt.Sprintf("included file '%s': %s", filePath, problem))
+		}
+
+		for _, def := range included.Definitions {
+			def.PathVal = relativeToFile(filePath, def.PathVal)
+			def.SettingsFileVal = relativeToFile(filePath, def.SettingsFileVal)
+
+			key := workerKey(def)
+			origin, ok := pluginOrigins[key]
+			pluginOrigins[key] = filePath
+
+			if !ok || origin == filePath {
+				dc.Definitions = append(dc.Definitions, def)
+				continue
+			}
+
+			dc.Definitions = replaceDefinition(dc.Definitions, def)
+			log.Infof("Plugin '%s (v%s)' from included file '%s' overrides the one from '%s'", def.Name(), def.Version(), filePath, origin)
+		}
+
+		for _, stage := range included.Stages {
+			origin, ok := stageOrigins[stage.Name]
+			stageOrigins[stage.Name] = filePath
+
+			if !ok || origin == filePath {
+				dc.Stages = append(dc.Stages, stage)
+				continue
+			}
+
+			dc.Stages = replaceStage(dc.Stages, stage)
+		}
+	}
+
+	return problems
+}
+
+// relativeToFile returns a path declared in a config file as relative
+// to the directory of that file.
+func relativeToFile(configFilePath string, filePath string) string {
+	if filePath == "" || filepath.IsAbs(filePath) {
+		return filePath
+	}
+
+	return filepath.Join(filepath.Dir(configFilePath), filePath)
+}
+
+// replaceDefinition puts def in place of the first definition with the
+// same name and version, and drops any other copy of it.
+func replaceDefinition(definitions []*defaultPluginDefinition, def *defaultPluginDefinition) []*defaultPluginDefinition {
+	var replaced []*defaultPluginDefinition
+	found := false
+	for _, d := range definitions {
+		if workerKey(d) != workerKey(def) {
+			replaced = append(replaced, d)
+			continue
+		}
+		if !found {
+			replaced = append(replaced, def)
+			found = true
+		}
+	}
+
+	return replaced
+}
+
+// replaceStage puts stage in place of the first stage with the same
+// name, and drops any other copy of it.
+func replaceStage(stages []*stageDefinition, stage *stageDefinition) []*stageDefinition {
+	var replaced []*stageDefinition
+	found := false
+	for _, s := range stages {
+		if s.Name != stage.Name {
+			replaced = append(replaced, s)
+			continue
+		}
+		if !found {
+			replaced = append(replaced, stage)
+			found = true
+		}
+	}
+
+	return replaced
+}
@@ -0,0 +1,183 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ourstudio-se/ouretl-abstractions"
+	"github.com/radovskyb/watcher"
+)
+
+func writeIncludeDir(dirPath string, files map[string]string) {
+	os.RemoveAll(dirPath)
+	os.MkdirAll(dirPath, 0700)
+
+	for name, content := range files {
+		ioutil.WriteFile(dirPath+"/"+name, []byte(content), 0600)
+	}
+}
+
+func TestThatIncludedPluginsAreMergedInOrder(t *testing.T) {
+	writeIncludeDir("/tmp/confd1", map[string]string{
+		"20-b.toml": "[[plugin]]\nname = \"router-2\"\nbuiltin = \"router\"\nversion = \"1.0.0\"\npriority = 20\n",
+		"10-a.yaml": "plugin:\n  - name: router-1\n    builtin: router\n    version: 1.0.0\n    priority: 15\n",
+		"README.md": "not a config file",
+	})
+
+	configFilePath := "/tmp/config22.conf"
+	configString := "include = [\"confd1/*.toml\", \"confd1/*.yaml\"]\n\n[[plugin]]\nname = \"router-1\"\nbuiltin = \"router\"\nversion = \"1.0.0\"\npriority = 10\n"
+	ioutil.WriteFile(configFilePath, []byte(configString), 0600)
+
+	config, err := NewStrictConfigFromTOMLFile(configFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pdefs := config.PluginDefinitions()
+	if len(pdefs) != 2 {
+		t.Fatalf("Expected 2 plugins, but got %d", len(pdefs))
+	}
+	if pdefs[0].Name() != "router-1" || pdefs[0].Priority() != 15 {
+		t.Errorf("Expected included 'router-1' to override the one in the config file, but got priority %d", pdefs[0].Priority())
+	}
+	if pdefs[1].Name() != "router-2" {
+		t.Errorf("Expected included plugin 'router-2', but got '%s'", pdefs[1].Name())
+	}
+}
+
+func TestThatLaterIncludedFileWins(t *testing.T) {
+	writeIncludeDir("/tmp/confd2", map[string]string{
+		"10-a.toml":  "[[plugin]]\nname = \"router-1\"\nbuiltin = \"router\"\nversion = \"1.0.0\"\npriority = 10\n",
+		"20-b.json":  "{\"plugin\": [{\"name\": \"router-1\", \"builtin\": \"router\", \"version\": \"1.0.0\", \"priority\": 20}]}",
+		"30-c.txt":   "[[plugin]]\nname = \"router-1\"\nbuiltin = \"router\"\nversion = \"1.0.0\"\npriority = 30\n",
+		"40-d.toml~": "[[plugin]]\nname = \"router-1\"\nbuiltin = \"router\"\nversion = \"1.0.0\"\npriority = 40\n",
+	})
+
+	configFilePath := "/tmp/config23.conf"
+	ioutil.WriteFile(configFilePath, []byte("include = [\"/tmp/confd2\"]\n"), 0600)
+
+	config, err := readConfigFromFile(configFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.Definitions) != 1 || config.Definitions[0].Priority() != 20 {
+		t.Errorf("Expected only 'router-1' from the last config file in the directory, but got %v", config.Definitions)
+	}
+}
+
+func TestThatIncludedFileProblemsAreReported(t *testing.T) {
+	writeIncludeDir("/tmp/confd3", map[string]string{
+		"a.toml": "include = [\"/tmp/confd3/*.toml\"]\nconcurrency = 4\n\n[[plugin]]\nname = \"router-1\"\nbuiltin = \"router\"\nversion = \"1.0.0\"\n\n[[plugin]]\nname = \"router-1\"\nbuiltin = \"router\"\nversion = \"1.0.0\"\n",
+	})
+
+	configFilePath := "/tmp/config24.conf"
+	ioutil.WriteFile(configFilePath, []byte("include = [\"/tmp/confd3/*.toml\"]\n"), 0600)
+
+	err := ValidateConfigFile(configFilePath, "")
+	ve, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("Expected a validation error, but got '%v'", err)
+	}
+
+	problems := strings.Join(ve.Problems, "\n")
+	for _, expected := range []string{
+		"included file '/tmp/confd3/a.toml' has unknown key 'include'",
+		"included file '/tmp/confd3/a.toml' has unknown key 'concurrency'",
+		"plugin 'router-1 (v1.0.0)' is declared more than once",
+	} {
+		if !strings.Contains(problems, expected) {
+			t.Errorf("Expected problem \"%s\", but got %v", expected, ve.Problems)
+		}
+	}
+}
+
+func TestThatIncludedDirectoryChangesReloadConfig(t *testing.T) {
+	writeIncludeDir("/tmp/confd4", map[string]string{
+		"a.toml": "[[plugin]]\nname = \"router-1\"\nbuiltin = \"router\"\nversion = \"1.0.0\"\n",
+	})
+
+	configFilePath := "/tmp/config25.conf"
+	ioutil.WriteFile(configFilePath, []byte("include = [\"/tmp/confd4\"]\n"), 0600)
+
+	config, err := readConfigFromFile(configFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fw := newFileWatch(watcher.New())
+	fw.track(configFilePath)
+	fw.trackIncludes(config)
+
+	var added, deactivated []string
+	config.OnPluginDefinitionAdded(func(pdef ouretl.PluginDefinition) {
+		added = append(added, pdef.Name())
+	})
+	config.OnPluginDefinitionDeactivated(func(pdef ouretl.PluginDefinition) {
+		deactivated = append(deactivated, pdef.Name())
+	})
+
+	newFilePath := "/tmp/confd4/b.toml"
+	ioutil.WriteFile(newFilePath, []byte("[[plugin]]\nname = \"router-2\"\nbuiltin = \"router\"\nversion = \"1.0.0\"\n"), 0600)
+	config.handleFileEvent(fw, configFilePath, watcher.Event{Op: watcher.Create, Path: newFilePath})
+
+	if len(added) != 1 || added[0] != "router-2" {
+		t.Errorf("Expected new included file to add 'router-2', but got %v", added)
+	}
+
+	os.Remove("/tmp/confd4/a.toml")
+	config.handleFileEvent(fw, configFilePath, watcher.Event{Op: watcher.Remove, Path: "/tmp/confd4/a.toml"})
+
+	if len(deactivated) != 1 || deactivated[0] != "router-1" {
+		t.Errorf("Expected removed included file to deactivate 'router-1', but got %v", deactivated)
+	}
+}
+
+func TestThatRelativePathsInIncludedFilesAreRelativeToThem(t *testing.T) {
+	writeIncludeDir("/tmp/confd5", map[string]string{
+		"10-a.toml": "[[plugin]]\nname = \"writer\"\npath = \"plugins/writer.so\"\nversion = \"1.0.0\"\nsettings_file = \"settings/writer.toml\"\n",
+	})
+
+	configFilePath := "/tmp/config29.conf"
+	ioutil.WriteFile(configFilePath, []byte("include = [\"confd5\"]\n"), 0600)
+
+	config, err := readConfigFromFile(configFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pdef := config.Definitions[0]
+	if pdef.FilePath() != "/tmp/confd5/plugins/writer.so" {
+		t.Errorf("Expected path to be relative to the included file, but got '%s'", pdef.FilePath())
+	}
+	if pdef.SettingsFileVal != "/tmp/confd5/settings/writer.toml" {
+		t.Errorf("Expected settings file to be relative to the included file, but got '%s'", pdef.SettingsFileVal)
+	}
+}
+
+func TestThatIncludedPluginOverridesEveryCopyInEarlierFile(t *testing.T) {
+	writeIncludeDir("/tmp/confd6", map[string]string{
+		"10-a.toml": "[[plugin]]\nname = \"router-1\"\nbuiltin = \"router\"\nversion = \"1.0.0\"\npriority = 30\n",
+	})
+
+	configFilePath := "/tmp/config30.conf"
+	configString := "include = [\"confd6\"]\n\n[[plugin]]\nname = \"router-1\"\nbuiltin = \"router\"\nversion = \"1.0.0\"\npriority = 10\n\n[[plugin]]\nname = \"router-2\"\nbuiltin = \"router\"\nversion = \"1.0.0\"\npriority = 20\n\n[[plugin]]\nname = \"router-1\"\nbuiltin = \"router\"\nversion = \"1.0.0\"\npriority = 40\n"
+	ioutil.WriteFile(configFilePath, []byte(configString), 0600)
+
+	config, err := readConfigFromFile(configFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var priorities []int
+	for _, pdef := range config.Definitions {
+		if pdef.Name() == "router-1" {
+			priorities = append(priorities, pdef.Priority())
+		}
+	}
+	if len(priorities) != 1 || priorities[0] != 30 {
+		t.Errorf("Expected a single 'router-1' from the included file, but got priorities %v", priorities)
+	}
+}
@@ -0,0 +1,138 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// interpolator expands `${VAR}` and `${VAR:-default}` in the string
+// values of a decoded config, from the environment. In the `path` and
+// `settings_file` of a plugin, `${name}` and `${version}` refer to the
+// name and version of the plugin. Settings are not expanded, since they
+// have environment overrides and secret references of their own, and
+// neither are router rules, whose regexes may contain `${`.
+type interpolator struct {
+	problems []string
+}
+
+// interpolate expands every string value of a decoded config, and
+// returns the references that could not be expanded.
+func interpolate(config interface{}) []string {
+	ip := &interpolator{}
+	ip.walk(reflect.ValueOf(config), lookupEnv)
+	return ip.problems
+}
+
+func lookupEnv(name string) (string, bool) {
+	return os.LookupEnv(name)
+}
+
+func (ip *interpolator) walk(v reflect.Value, lookup func(string) (string, bool)) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return
+		}
+		if def, ok := v.Interface().(*defaultPluginDefinition); ok {
+			ip.definition(def)
+			return
+		}
+		ip.walk(v.Elem(), lookup)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Field(i).CanSet() {
+				ip.walk(v.Field(i), lookup)
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			ip.walk(v.Index(i), lookup)
+		}
+	case reflect.String:
+		if v.CanSet() {
+			v.SetString(ip.expand(v.String(), lookup))
+		}
+	}
+}
+
+func (ip *interpolator) definition(def *defaultPluginDefinition) {
+	v := reflect.ValueOf(def).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		switch v.Type().Field(i).Name {
+		case "PathVal", "SettingsFileVal", "RulesVal":
+			continue
+		}
+		if v.Field(i).CanSet() {
+			ip.walk(v.Field(i), lookupEnv)
+		}
+	}
+
+	siblings := func(name string) (string, bool) {
+		switch name {
+		case "name":
+			return def.NameVal, true
+		case "version":
+			return def.VersionVal, true
+		}
+		return lookupEnv(name)
+	}
+
+	def.PathVal = ip.expand(def.PathVal, siblings)
+	def.SettingsFileVal = ip.expand(def.SettingsFileVal, siblings)
+}
+
+// expand replaces every `${VAR}` and `${VAR:-default}` in s, where the
+// default is used if VAR is unset or empty. `$${` is kept as a literal
+// `${`. A reference to an unset variable without a default is a
+// problem, and is replaced by an empty string.
+func (ip *interpolator) expand(s string, lookup func(string) (string, bool)) string {
+	if !strings.Contains(s, "${") {
+		return s
+	}
+
+	var b strings.Builder
+	rest := s
+	for {
+		i := strings.Index(rest, "${")
+		if i < 0 {
+			b.WriteString(rest)
+			break
+		}
+
+		if i > 0 && rest[i-1] == '$' {
+			b.WriteString(rest[:i-1] + "${")
+			rest = rest[i+2:]
+			continue
+		}
+
+		end := strings.Index(rest[i:], "}")
+		if end < 0 {
+			ip.problems = append(ip.problems, fmt.Sprintf("value '%s' has a '${' without a closing '}'", s))
+			b.WriteString(rest)
+			break
+		}
+
+		b.WriteString(rest[:i])
+		reference := rest[i+2 : i+end]
+		rest = rest[i+end+1:]
+
+		name, fallback, hasDefault := reference, "", false
+		if j := strings.Index(reference, ":-"); j >= 0 {
+			name, fallback, hasDefault = reference[:j], reference[j+2:], true
+		}
+
+		value, ok := lookup(name)
+		switch {
+		case ok && value != "":
+			b.WriteString(value)
+		case hasDefault:
+			b.WriteString(fallback)
+		case !ok:
+			ip.problems = append(ip.problems, fmt.Sprintf("value '%s' refers to environment variable '%s', which is not set", s, name))
+		}
+	}
+
+	return b.String()
+}
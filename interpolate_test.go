@@ -0,0 +1,99 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestThatConfigValuesAreInterpolated(t *testing.T) {
+	os.Setenv("OURETL_TEST_PLUGIN_DIR", "/opt/plugins")
+	defer os.Unsetenv("OURETL_TEST_PLUGIN_DIR")
+
+	configFilePath := "/tmp/config27.conf"
+	configString := "[[plugin]]\nname = \"stdout-writer\"\npath = \"${OURETL_TEST_PLUGIN_DIR}/${name}.so.${version}\"\nversion = \"${OURETL_TEST_VERSION:-1.0.0}\"\nsettings_file = \"${OURETL_TEST_SETTINGS_DIR:-/etc/ouretl}/${name}-${version}.toml\"\n\n[plugin.settings]\ntemplate = \"${name}\"\n"
+	ioutil.WriteFile(configFilePath, []byte(configString), 0600)
+
+	config, err := readConfigFromFile(configFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pdef := config.Definitions[0]
+	if pdef.Version() != "1.0.0" {
+		t.Errorf("Expected version to fall back to '1.0.0', but got '%s'", pdef.Version())
+	}
+	if pdef.FilePath() != "/opt/plugins/stdout-writer.so.1.0.0" {
+		t.Errorf("Expected path to be '/opt/plugins/stdout-writer.so.1.0.0', but got '%s'", pdef.FilePath())
+	}
+	if pdef.SettingsFileVal != "/etc/ouretl/stdout-writer-1.0.0.toml" {
+		t.Errorf("Expected settings file to be '/etc/ouretl/stdout-writer-1.0.0.toml', but got '%s'", pdef.SettingsFileVal)
+	}
+	if value := pdef.inlineSettings()["template"]; value != "${name}" {
+		t.Errorf("Expected settings not to be interpolated, but got '%v'", value)
+	}
+}
+
+func TestThatInterpolationExpandsReferences(t *testing.T) {
+	os.Setenv("OURETL_TEST_SET", "set")
+	os.Setenv("OURETL_TEST_EMPTY", "")
+	defer os.Unsetenv("OURETL_TEST_SET")
+	defer os.Unsetenv("OURETL_TEST_EMPTY")
+
+	expected := map[string]string{
+		"plain":                                "plain",
+		"${OURETL_TEST_SET}":                   "set",
+		"a-${OURETL_TEST_SET}-b":               "a-set-b",
+		"${OURETL_TEST_SET:-default}":          "set",
+		"${OURETL_TEST_EMPTY:-default}":        "default",
+		"${OURETL_TEST_UNSET:-default}":        "default",
+		"${OURETL_TEST_UNSET:-}":               "",
+		"${OURETL_TEST_EMPTY}":                 "",
+		"$${OURETL_TEST_SET}":                  "${OURETL_TEST_SET}",
+		"${OURETL_TEST_SET}${OURETL_TEST_SET}": "setset",
+	}
+
+	for value, expectedValue := range expected {
+		ip := &interpolator{}
+		if expanded := ip.expand(value, lookupEnv); expanded != expectedValue || len(ip.problems) > 0 {
+			t.Errorf("Expected '%s' to expand to '%s', but got '%s' with problems %v", value, expectedValue, expanded, ip.problems)
+		}
+	}
+}
+
+func TestThatUnsetVariableFailsStrictConfig(t *testing.T) {
+	configFilePath := "/tmp/config28.conf"
+	configString := "[[plugin]]\nname = \"router-1\"\nbuiltin = \"router\"\nversion = \"${OURETL_TEST_UNSET}\"\n\n[[plugin]]\nname = \"router-2\"\nbuiltin = \"router\"\nversion = \"${OURETL_TEST_UNCLOSED\"\n"
+	ioutil.WriteFile(configFilePath, []byte(configString), 0600)
+
+	err := ValidateConfigFile(configFilePath, "")
+	ve, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("Expected a validation error, but got '%v'", err)
+	}
+
+	problems := strings.Join(ve.Problems, "\n")
+	if !strings.Contains(problems, "refers to environment variable 'OURETL_TEST_UNSET', which is not set") {
+		t.Errorf("Expected unset variable to be a problem, but got %v", ve.Problems)
+	}
+	if !strings.Contains(problems, "without a closing '}'") {
+		t.Errorf("Expected unclosed reference to be a problem, but got %v", ve.Problems)
+	}
+}
+
+func TestThatRouterRulesAreNotInterpolated(t *testing.T) {
+	configFilePath := "/tmp/config31.conf"
+	configString := "[[plugin]]\nname = \"router-1\"\nbuiltin = \"router\"\nversion = \"1.0.0\"\n\n[[plugin.rule]]\nroute = \"numbers\"\njson_path = \"$.body\"\nregex = \"^[0-9]+${1}\"\n"
+	ioutil.WriteFile(configFilePath, []byte(configString), 0600)
+
+	config, err := readConfigFromFile(configFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules := config.Definitions[0].rules()
+	if len(rules) != 1 || rules[0].Regex != "^[0-9]+${1}" {
+		t.Errorf("Expected rule regex to be kept as written, but got %v", rules)
+	}
+}
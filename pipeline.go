@@ -0,0 +1,169 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	ouretl "github.com/ourstudio-se/ouretl-abstractions"
+	log "github.com/sirupsen/logrus"
+)
+
+type stageDefinition struct {
+	Name   string   `toml:"name" json:"name" yaml:"name"`
+	Plugin string   `toml:"plugin" json:"plugin" yaml:"plugin"`
+	Next   []string `toml:"next" json:"next" yaml:"next"`
+}
+
+type pipelineConfig interface {
+	stageDefinitions() []*stageDefinition
+}
+
+// pipeline is a directed acyclic graph of stages, each running a
+// `DataHandlerPlugin`. When a stage calls `next`, the data is passed on
+// to every stage listed in its `next`. Branches are independent: an
+// error in one branch is reported through onBranchError, and does not
+// stop the other branches or fail the stage that fanned out.
+type pipeline struct {
+	stages  map[string]*stageDefinition
+	entries []string
+}
+
+func newPipeline(defs []*stageDefinition) (*pipeline, error) {
+	p := &pipeline{stages: make(map[string]*stageDefinition)}
+
+	for _, def := range defs {
+		if def.Name == "" {
+			return nil, fmt.Errorf("pipeline stage for plugin '%s' has no name", def.Plugin)
+		}
+		if _, ok := p.stages[def.Name]; ok {
+			return nil, fmt.Errorf("pipeline stage '%s' is declared more than once", def.Name)
+		}
+		if def.Plugin == "" {
+			return nil, fmt.Errorf("pipeline stage '%s' has no plugin", def.Name)
+		}
+
+		p.stages[def.Name] = def
+	}
+
+	referenced := make(map[string]bool)
+	for _, def := range defs {
+		for _, next := range def.Next {
+			if _, ok := p.stages[next]; !ok {
+				return nil, fmt.Errorf("pipeline stage '%s' refers to unknown stage '%s'", def.Name, next)
+			}
+			referenced[next] = true
+		}
+	}
+
+	for _, def := range defs {
+		if !referenced[def.Name] {
+			p.entries = append(p.entries, def.Name)
+		}
+	}
+
+	if len(p.entries) == 0 {
+		return nil, fmt.Errorf("pipeline has no entry stage")
+	}
+
+	visiting := make(map[string]bool)
+	visited := make(map[string]bool)
+	for _, name := range p.entries {
+		if err := p.detectCycle(name, visiting, visited); err != nil {
+			return nil, err
+		}
+	}
+	for _, def := range defs {
+		if !visited[def.Name] {
+			return nil, fmt.Errorf("pipeline stage '%s' is part of a cycle", def.Name)
+		}
+	}
+
+	return p, nil
+}
+
+func (p *pipeline) detectCycle(name string, visiting, visited map[string]bool) error {
+	if visiting[name] {
+		return fmt.Errorf("pipeline stage '%s' is part of a cycle", name)
+	}
+	if visited[name] {
+		return nil
+	}
+
+	visiting[name] = true
+	for _, next := range p.stages[name].Next {
+		if err := p.detectCycle(next, visiting, visited); err != nil {
+			return err
+		}
+	}
+	visiting[name] = false
+	visited[name] = true
+
+	return nil
+}
+
+func pipelineFromConfig(config ouretl.Config) (*pipeline, error) {
+	c, ok := config.(pipelineConfig)
+	if !ok || len(c.stageDefinitions()) == 0 {
+		return nil, nil
+	}
+
+	return newPipeline(c.stageDefinitions())
+}
+
+func (p *pipeline) process(ctx context.Context, pool []*wrapper, dm *DefaultDataMessage, onBranchError func(error)) error {
+	log.Debugf("Processing a new message with ID '%s' through pipeline, initiated from worker '%s'", dm.ID(), dm.Origin())
+	startedAt := time.Now()
+
+	err := p.call(ctx, p.entries, pool, dm, dm.Data(), onBranchError)
+
+	ms := int64(time.Since(startedAt) / time.Millisecond)
+	log.Debugf("Message with ID '%s' processed by pipeline in %d ms", dm.ID(), ms)
+
+	return err
+}
+
+func (p *pipeline) call(ctx context.Context, names []string, pool []*wrapper, parent *DefaultDataMessage, data []byte, onBranchError func(error)) error {
+	if len(names) == 1 {
+		return p.callStage(ctx, names[0], pool, parent, data, onBranchError)
+	}
+
+	for _, name := range names {
+		if err := p.callStage(ctx, name, pool, parent, data, onBranchError); err != nil {
+			log.Error(err)
+			onBranchError(err)
+		}
+	}
+
+	return nil
+}
+
+func (p *pipeline) callStage(ctx context.Context, name string, pool []*wrapper, parent *DefaultDataMessage, data []byte, onBranchError func(error)) error {
+	stage := p.stages[name]
+
+	w := findHandler(pool, stage.Plugin)
+	if w == nil || !w.definition.IsActive() {
+		log.Debugf("Pipeline stage '%s' has no active `DataHandlerPlugin` '%s', passing message through", name, stage.Plugin)
+		return p.call(ctx, stage.Next, pool, parent, data, onBranchError)
+	}
+	if !acceptsMessage(w.definition, parent) {
+		log.Debugf("Pipeline stage '%s' does not accept messages from worker '%s', ending branch", name, parent.Origin())
+		return nil
+	}
+
+	next := func(ctx context.Context, message *DefaultDataMessage, data []byte) error {
+		return p.call(ctx, stage.Next, pool, message, data, onBranchError)
+	}
+
+	return newDataFunc(w, next)(ctx, parent, data)
+}
+
+func findHandler(pool []*wrapper, name string) *wrapper {
+	for _, x := range pool {
+		if x.definition.Name() == name {
+			return x
+		}
+	}
+
+	return nil
+}
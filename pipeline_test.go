@@ -0,0 +1,132 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	ouretl "github.com/ourstudio-se/ouretl-abstractions"
+)
+
+func newNamedWrapper(name string, impl ouretl.DataHandlerPlugin) *wrapper {
+	return &wrapper{
+		definition:     &defaultPluginDefinition{NameVal: name, VersionVal: "1.0.0", isActive: true},
+		implementation: impl,
+	}
+}
+
+func TestThatPipelineFansOutToAllBranches(t *testing.T) {
+	p, err := newPipeline([]*stageDefinition{
+		{Name: "transform", Plugin: "transform", Next: []string{"archive", "search"}},
+		{Name: "archive", Plugin: "archive"},
+		{Name: "search", Plugin: "search"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var archived, searched string
+	pool := []*wrapper{
+		newNamedWrapper("transform", &mockTransformPluginImpl{}),
+		newNamedWrapper("archive", &mockDataRecorder{record: func(dm ouretl.DataMessage) {
+			archived = string(dm.Data())
+		}}),
+		newNamedWrapper("search", &mockDataRecorder{record: func(dm ouretl.DataMessage) {
+			searched = string(dm.Data())
+		}}),
+	}
+
+	err = p.process(context.Background(), pool, &DefaultDataMessage{id: "test", data: []byte("test")}, func(err error) {
+		t.Error(err)
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if archived != "test-transformed" {
+		t.Errorf("Archive branch did not receive transformed data, got '%s'", archived)
+	}
+	if searched != "test-transformed" {
+		t.Errorf("Search branch did not receive transformed data, got '%s'", searched)
+	}
+}
+
+func TestThatFailingBranchDoesNotStopOtherBranches(t *testing.T) {
+	p, err := newPipeline([]*stageDefinition{
+		{Name: "transform", Plugin: "transform", Next: []string{"archive", "search"}},
+		{Name: "archive", Plugin: "archive"},
+		{Name: "search", Plugin: "search"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	searched := false
+	pool := []*wrapper{
+		newNamedWrapper("transform", &mockTransformPluginImpl{}),
+		newNamedWrapper("archive", &mockFailingPluginImpl{err: errors.New("archive unavailable")}),
+		newNamedWrapper("search", &mockDataRecorder{record: func(_ ouretl.DataMessage) {
+			searched = true
+		}}),
+	}
+
+	var branchErrors []error
+	err = p.process(context.Background(), pool, &DefaultDataMessage{id: "test", data: []byte("test")}, func(err error) {
+		branchErrors = append(branchErrors, err)
+	})
+	if err != nil {
+		t.Errorf("Failing branch caused the pipeline to fail: %v", err)
+	}
+
+	if !searched {
+		t.Error("Search branch was not called after archive branch failed")
+	}
+	if len(branchErrors) != 1 {
+		t.Fatalf("Expected 1 branch error, but got %d", len(branchErrors))
+	}
+
+	dl := newDeadLetter(&DefaultDataMessage{id: "test"}, branchErrors[0])
+	if dl.PluginName != "archive" || string(dl.Payload) != "test-transformed" {
+		t.Errorf("Branch error did not point out failing plugin and payload, got '%s' and '%s'", dl.PluginName, string(dl.Payload))
+	}
+}
+
+func TestThatPipelineWithCycleIsRejected(t *testing.T) {
+	_, err := newPipeline([]*stageDefinition{
+		{Name: "entry", Plugin: "entry", Next: []string{"a"}},
+		{Name: "a", Plugin: "a", Next: []string{"b"}},
+		{Name: "b", Plugin: "b", Next: []string{"a"}},
+	})
+	if err == nil {
+		t.Error("Pipeline with a cycle was not rejected")
+	}
+}
+
+func TestThatPipelineWithUnknownStageIsRejected(t *testing.T) {
+	_, err := newPipeline([]*stageDefinition{
+		{Name: "entry", Plugin: "entry", Next: []string{"missing"}},
+	})
+	if err == nil {
+		t.Error("Pipeline referring to an unknown stage was not rejected")
+	}
+}
+
+func TestThatReadConfigParsesPipelineStages(t *testing.T) {
+	configFilePath := "/tmp/config6.conf"
+	configString := "[[stage]]\nname = \"transform\"\nplugin = \"transform\"\nnext = [\"archive\", \"search\"]\n\n[[stage]]\nname = \"archive\"\nplugin = \"archive\"\n\n[[stage]]\nname = \"search\"\nplugin = \"search\"\n"
+	ioutil.WriteFile(configFilePath, []byte(configString), 0600)
+
+	config, err := readConfigFromFile(configFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := pipelineFromConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.entries) != 1 || p.entries[0] != "transform" {
+		t.Errorf("Expected 'transform' as the only entry stage, got %v", p.entries)
+	}
+}
@@ -1,15 +1,33 @@
 package core
 
-import ouretl "github.com/ourstudio-se/ouretl-abstractions"
+import (
+	"sync"
+
+	ouretl "github.com/ourstudio-se/ouretl-abstractions"
+)
 
 type defaultPluginDefinition struct {
-	NameVal         string `toml:"name"`
-	PathVal         string `toml:"path"`
-	VersionVal      string `toml:"version"`
-	PriorityVal     int    `toml:"priority"`
-	SettingsFileVal string `toml:"settings_file"`
-	isActive        bool
-	settings        *defaultPluginSettings
+	NameVal           string                 `toml:"name" json:"name" yaml:"name"`
+	PathVal           string                 `toml:"path" json:"path" yaml:"path"`
+	VersionVal        string                 `toml:"version" json:"version" yaml:"version"`
+	PriorityVal       int                    `toml:"priority" json:"priority" yaml:"priority"`
+	SettingsFileVal   string                 `toml:"settings_file" json:"settings_file" yaml:"settings_file"`
+	SettingsFormatVal string                 `toml:"settings_format" json:"settings_format" yaml:"settings_format"`
+	SettingsVal       map[string]interface{} `toml:"settings" json:"settings" yaml:"settings"`
+	EnvPrefixVal      *string                `toml:"env_prefix" json:"env_prefix" yaml:"env_prefix"`
+	RetryVal          *retryPolicy           `toml:"retry" json:"retry" yaml:"retry"`
+	RestartVal        *restartPolicy         `toml:"restart" json:"restart" yaml:"restart"`
+	SourcesVal        []string               `toml:"sources" json:"sources" yaml:"sources"`
+	PipelineVal       string                 `toml:"pipeline" json:"pipeline" yaml:"pipeline"`
+	RoutesVal         []string               `toml:"routes" json:"routes" yaml:"routes"`
+	BuiltinVal        string                 `toml:"builtin" json:"builtin" yaml:"builtin"`
+	RulesVal          []*ruleDefinition      `toml:"rule" json:"rule" yaml:"rule"`
+	mu                sync.RWMutex
+	loadPathVal       string
+	prevLoadPathVal   string
+	isActive          bool
+	settings          *defaultPluginSettings
+	settingsErr       error
 }
 
 func (dpd *defaultPluginDefinition) Name() string {
@@ -25,17 +43,193 @@ func (dpd *defaultPluginDefinition) Version() string {
 }
 
 func (dpd *defaultPluginDefinition) Priority() int {
+	dpd.mu.RLock()
+	defer dpd.mu.RUnlock()
+
 	return dpd.PriorityVal
 }
 
+func (dpd *defaultPluginDefinition) setPriority(priority int) {
+	dpd.mu.Lock()
+	defer dpd.mu.Unlock()
+
+	dpd.PriorityVal = priority
+}
+
 func (dpd *defaultPluginDefinition) Settings() ouretl.PluginSettings {
 	return dpd.settings
 }
 
 func (dpd *defaultPluginDefinition) IsActive() bool {
+	dpd.mu.RLock()
+	defer dpd.mu.RUnlock()
+
 	return dpd.isActive
 }
 
+func (dpd *defaultPluginDefinition) setActive(isActive bool) {
+	dpd.mu.Lock()
+	defer dpd.mu.Unlock()
+
+	dpd.isActive = isActive
+}
+
+func (dpd *defaultPluginDefinition) retryPolicy() *retryPolicy {
+	return dpd.RetryVal
+}
+
+func (dpd *defaultPluginDefinition) restartPolicy() *restartPolicy {
+	return dpd.RestartVal
+}
+
+func (dpd *defaultPluginDefinition) sources() []string {
+	return dpd.SourcesVal
+}
+
+func (dpd *defaultPluginDefinition) pipelineName() string {
+	return dpd.PipelineVal
+}
+
+func (dpd *defaultPluginDefinition) routes() []string {
+	return dpd.RoutesVal
+}
+
+func (dpd *defaultPluginDefinition) builtin() string {
+	return dpd.BuiltinVal
+}
+
+func (dpd *defaultPluginDefinition) rules() []*ruleDefinition {
+	return dpd.RulesVal
+}
+
+func (dpd *defaultPluginDefinition) loadPath() string {
+	dpd.mu.RLock()
+	defer dpd.mu.RUnlock()
+
+	return dpd.loadPathVal
+}
+
+func (dpd *defaultPluginDefinition) setLoadPath(loadPath string) {
+	dpd.mu.Lock()
+	defer dpd.mu.Unlock()
+
+	dpd.prevLoadPathVal = dpd.loadPathVal
+	dpd.loadPathVal = loadPath
+}
+
+// restoreLoadPath goes back to the path the plugin was loaded from
+// before, if loadPath failed to load.
+func (dpd *defaultPluginDefinition) restoreLoadPath(loadPath string) {
+	dpd.mu.Lock()
+	defer dpd.mu.Unlock()
+
+	if dpd.loadPathVal == loadPath {
+		dpd.loadPathVal = dpd.prevLoadPathVal
+	}
+}
+
+func (dpd *defaultPluginDefinition) settingsError() error {
+	dpd.mu.RLock()
+	defer dpd.mu.RUnlock()
+
+	return dpd.settingsErr
+}
+
+func (dpd *defaultPluginDefinition) setSettingsError(err error) {
+	dpd.mu.Lock()
+	defer dpd.mu.Unlock()
+
+	dpd.settingsErr = err
+}
+
+func (dpd *defaultPluginDefinition) inlineSettings() map[string]interface{} {
+	dpd.mu.RLock()
+	defer dpd.mu.RUnlock()
+
+	return dpd.SettingsVal
+}
+
+func (dpd *defaultPluginDefinition) setInlineSettings(settings map[string]interface{}) {
+	dpd.mu.Lock()
+	defer dpd.mu.Unlock()
+
+	dpd.SettingsVal = settings
+}
+
+type inlineSettingsDefinition interface {
+	inlineSettings() map[string]interface{}
+}
+
+func inlineSettingsFor(pdef ouretl.PluginDefinition) map[string]interface{} {
+	if d, ok := pdef.(inlineSettingsDefinition); ok {
+		return d.inlineSettings()
+	}
+
+	return nil
+}
+
+func (dpd *defaultPluginDefinition) envPrefix() *string {
+	return dpd.EnvPrefixVal
+}
+
+type envPrefixDefinition interface {
+	envPrefix() *string
+}
+
+func envPrefixFor(pdef ouretl.PluginDefinition) *string {
+	if d, ok := pdef.(envPrefixDefinition); ok {
+		return d.envPrefix()
+	}
+
+	return nil
+}
+
+func (dpd *defaultPluginDefinition) settingsFile() (string, string) {
+	return dpd.SettingsFileVal, dpd.SettingsFormatVal
+}
+
+type settingsFileDefinition interface {
+	settingsFile() (string, string)
+}
+
+// settingsFileFor returns the settings file of a definition, and the
+// format it is declared in, if any.
+func settingsFileFor(pdef ouretl.PluginDefinition) (string, string) {
+	if d, ok := pdef.(settingsFileDefinition); ok {
+		return d.settingsFile()
+	}
+
+	return "", ""
+}
+
+type settingsErrorDefinition interface {
+	settingsError() error
+}
+
+// settingsErrorFor returns the error from reading the settings file of
+// a definition, which keeps the plugin from being loaded.
+func settingsErrorFor(pdef ouretl.PluginDefinition) error {
+	if d, ok := pdef.(settingsErrorDefinition); ok {
+		return d.settingsError()
+	}
+
+	return nil
+}
+
+type loadPathDefinition interface {
+	loadPath() string
+}
+
+// pluginPathFor returns the path to open the plugin binary from, which
+// is a staged copy once the binary at the configured path has changed.
+func pluginPathFor(pdef ouretl.PluginDefinition) string {
+	if d, ok := pdef.(loadPathDefinition); ok && d.loadPath() != "" {
+		return d.loadPath()
+	}
+
+	return pdef.FilePath()
+}
+
 type byPriority []*defaultPluginDefinition
 
 func (w byPriority) Len() int {
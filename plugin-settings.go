@@ -1,40 +1,258 @@
 package core
 
 import (
+	"fmt"
 	"os"
+	"strings"
+	"sync"
+	"unicode"
 
-	"github.com/BurntSushi/toml"
+	ouretl "github.com/ourstudio-se/ouretl-abstractions"
+	log "github.com/sirupsen/logrus"
 )
 
+const defaultEnvPrefix = "OURETL_"
+
 type defaultPluginSettings struct {
+	mu              sync.RWMutex
 	settings        map[string]interface{}
 	overrideFromEnv bool
+	envPrefix       string
+	// owner, secretKeyFile and secretKeys are used to resolve and redact
+	// secrets in values overridden from the environment.
+	owner         string
+	secretKeyFile string
+	secretKeys    map[string]bool
+	// fallback holds the settings of a definition from outside this
+	// package, for the keys it has that settings does not.
+	fallback ouretl.PluginSettings
+}
+
+// normalizeEnvName turns a plugin name or setting key into its form in
+// an environment variable name, e.g. `http-writer` into `HTTP_WRITER`.
+func normalizeEnvName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, name)
+}
+
+// envPrefixForPlugin returns the prefix of the environment variables
+// overriding settings of a plugin, i.e. `OURETL_<PLUGIN_NAME>_` unless
+// the definition has its own `env_prefix`.
+func envPrefixForPlugin(pdef ouretl.PluginDefinition) string {
+	if d, ok := pdef.(envPrefixDefinition); ok && d.envPrefix() != nil {
+		return *d.envPrefix()
+	}
+
+	return defaultEnvPrefix + normalizeEnvName(pdef.Name()) + "_"
+}
+
+// envNameFor returns the name of the environment variable overriding a
+// setting. An empty prefix keeps the key as it is written, like before
+// settings were namespaced by plugin.
+func envNameFor(prefix string, key string) string {
+	if prefix == "" {
+		return key
+	}
+
+	return prefix + normalizeEnvName(key)
+}
+
+func (dps *defaultPluginSettings) envName(key string) string {
+	return envNameFor(dps.envPrefix, key)
+}
+
+func (dps *defaultPluginSettings) envOverride() (bool, string) {
+	return dps.overrideFromEnv, dps.envPrefix
 }
 
 func (dps *defaultPluginSettings) Get(key string) (interface{}, bool) {
-	if dps.overrideFromEnv && os.Getenv(key) != "" {
-		return os.Getenv(key), true
+	if dps.overrideFromEnv {
+		if value := os.Getenv(dps.envName(key)); value != "" {
+			return dps.resolveOverride(key, value)
+		}
 	}
 
+	dps.mu.RLock()
 	value, ok := dps.settings[key]
+	dps.mu.RUnlock()
+
+	if !ok && dps.fallback != nil {
+		return dps.fallback.Get(key)
+	}
+
 	return value, ok
 }
 
-func readSettingsFromTOMLFile(settingsFilePath string) *defaultPluginSettings {
-	if _, err := os.Stat(settingsFilePath); err != nil {
-		return &defaultPluginSettings{
-			settings: make(map[string]interface{}),
+// resolveOverride resolves a secret reference in a value overridden
+// from the environment. The secret is redacted like the secrets of the
+// settings file, as is a plain value overriding a setting which held a
+// secret. A reference that cannot be resolved is logged, and the
+// setting is not found.
+func (dps *defaultPluginSettings) resolveOverride(key string, value string) (interface{}, bool) {
+	resolver := &secretResolver{keyFilePath: dps.secretKeyFile}
+	resolved, err := resolver.resolve(key, value)
+	if err != nil {
+		log.Errorf("Environment variable '%s' cannot be resolved: %v", dps.envName(key), err)
+		return nil, false
+	}
+
+	dps.mu.RLock()
+	heldSecret := dps.secretKeys[key]
+	dps.mu.RUnlock()
+
+	secrets := resolver.secrets
+	if len(secrets) == 0 && heldSecret {
+		secrets = resolver.redactable(resolved)
+	}
+	redactor.set(dps.owner+" "+dps.envName(key), secrets)
+
+	return resolved, true
+}
+
+// overridden returns the settings which are overridden from the
+// environment, mapped to the name of the environment variable.
+func (dps *defaultPluginSettings) overridden() map[string]string {
+	overrides := make(map[string]string)
+	if !dps.overrideFromEnv {
+		return overrides
+	}
+
+	dps.mu.RLock()
+	defer dps.mu.RUnlock()
+
+	for key := range dps.settings {
+		if os.Getenv(dps.envName(key)) != "" {
+			overrides[key] = dps.envName(key)
 		}
 	}
 
+	return overrides
+}
+
+// replace swaps in the values of next, so that plugins holding on to
+// these settings see the new values.
+func (dps *defaultPluginSettings) replace(next *defaultPluginSettings) {
+	dps.mu.Lock()
+	defer dps.mu.Unlock()
+
+	dps.settings = next.settings
+	dps.secretKeys = next.secretKeys
+}
+
+// skippedDefinitions remembers the definitions a pool did not load
+// because of their invalid settings, so that they are loaded once the
+// settings are fixed.
+type skippedDefinitions struct {
+	mu   sync.Mutex
+	keys map[string]bool
+}
+
+// add remembers a definition with invalid settings, if isPlugin tells
+// that it is a plugin of the kind the pool loads.
+func (sd *skippedDefinitions) add(pdef ouretl.PluginDefinition, isPlugin func(ouretl.PluginDefinition) bool) {
+	if settingsErrorFor(pdef) == nil || !isPlugin(pdef) {
+		return
+	}
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if sd.keys == nil {
+		sd.keys = make(map[string]bool)
+	}
+	sd.keys[workerKey(pdef)] = true
+}
+
+// retry tells if a definition was skipped, and forgets it.
+func (sd *skippedDefinitions) retry(pdef ouretl.PluginDefinition) bool {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	skipped := sd.keys[workerKey(pdef)]
+	delete(sd.keys, workerKey(pdef))
+	return skipped
+}
+
+func newPluginSettings() *defaultPluginSettings {
+	return &defaultPluginSettings{
+		settings: make(map[string]interface{}),
+	}
+}
+
+// readSettingsFromFile reads the settings file at settingsFilePath, in
+// the given format or the format of its extension. Parse errors tell
+// the file and line of the problem.
+func readSettingsFromFile(settingsFilePath string, format string) (*defaultPluginSettings, error) {
+	format, err := formatFor(settingsFilePath, format)
+	if err != nil {
+		return newPluginSettings(), fmt.Errorf("settings file '%s': %v", settingsFilePath, err)
+	}
+
 	var settings map[string]interface{}
-	if _, err := toml.DecodeFile(settingsFilePath, settings); err != nil {
-		return &defaultPluginSettings{
-			settings: make(map[string]interface{}),
+	if _, err := decodeFile(settingsFilePath, format, &settings); err != nil {
+		return newPluginSettings(), fmt.Errorf("settings file '%s': %v", settingsFilePath, err)
+	}
+	if settings == nil {
+		settings = make(map[string]interface{})
+	}
+
+	return &defaultPluginSettings{
+		settings: normalizeSettings(settings),
+	}, nil
+}
+
+// readSettings merges the inline settings of a plugin definition with
+// its settings file, if any. Values from the settings file take
+// precedence, and nested tables are merged key by key. Secret
+// references are resolved once the settings are merged, and replace
+// the secrets redacted for the owner of the settings.
+func readSettings(owner string, inline map[string]interface{}, settingsFilePath string, settingsFormat string, secretKeyFilePath string) (*defaultPluginSettings, error) {
+	settings := mergeSettings(make(map[string]interface{}), inline)
+	if settingsFilePath != "" {
+		fromFile, err := readSettingsFromFile(settingsFilePath, settingsFormat)
+		if err != nil {
+			return newPluginSettings(), err
 		}
+
+		settings = mergeSettings(settings, fromFile.settings)
 	}
 
+	resolver := &secretResolver{keyFilePath: secretKeyFilePath}
+	resolved, err := resolver.resolveSecrets("", settings)
+	if err != nil {
+		return newPluginSettings(), err
+	}
+	redactor.set(owner, resolver.secrets)
+
 	return &defaultPluginSettings{
-		settings: settings,
+		settings:      resolved.(map[string]interface{}),
+		owner:         owner,
+		secretKeyFile: secretKeyFilePath,
+		secretKeys:    resolver.keys,
+	}, nil
+}
+
+// mergeSettings copies the values of src into dst, merging tables that
+// exist in both instead of replacing them. Tables in src are copied, so
+// that src is never modified through dst.
+func mergeSettings(dst, src map[string]interface{}) map[string]interface{} {
+	for key, value := range src {
+		table, ok := value.(map[string]interface{})
+		if !ok {
+			dst[key] = value
+			continue
+		}
+
+		existing, ok := dst[key].(map[string]interface{})
+		if !ok {
+			existing = make(map[string]interface{})
+		}
+		dst[key] = mergeSettings(existing, table)
 	}
+
+	return dst
 }
@@ -0,0 +1,197 @@
+package core
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	ouretl "github.com/ourstudio-se/ouretl-abstractions"
+)
+
+func TestThatSettingsFileReachesPluginSettings(t *testing.T) {
+	settingsFilePath := "/tmp/settings3.toml"
+	ioutil.WriteFile(settingsFilePath, []byte("endpoint = \"http://localhost\"\nbatch_size = 10\n\n[tls]\nenabled = true\n"), 0600)
+
+	configFilePath := "/tmp/config11.conf"
+	configString := "[[plugin]]\nname = \"test-1\"\npath = \"/tmp/test-1\"\nversion = \"1.0.0\"\nsettings_file = \"" + settingsFilePath + "\"\n"
+	ioutil.WriteFile(configFilePath, []byte(configString), 0600)
+
+	config, err := readConfigFromFile(configFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings := config.PluginDefinitions()[0].Settings()
+	if value, ok := settings.Get("endpoint"); !ok || value != "http://localhost" {
+		t.Errorf("Expected setting 'endpoint' to be 'http://localhost', but got '%v'", value)
+	}
+	if value, ok := settings.Get("batch_size"); !ok || value != int64(10) {
+		t.Errorf("Expected setting 'batch_size' to be 10, but got '%v'", value)
+	}
+	if value, ok := settings.Get("tls"); !ok || value.(map[string]interface{})["enabled"] != true {
+		t.Errorf("Expected setting 'tls' to be a table, but got '%v'", value)
+	}
+}
+
+func TestThatSettingsFileParseErrorTellsFileAndLine(t *testing.T) {
+	settingsFilePath := "/tmp/settings4.toml"
+	ioutil.WriteFile(settingsFilePath, []byte("endpoint = \"http://localhost\"\nbatch_size = \n"), 0600)
+
+	_, err := readSettingsFromFile(settingsFilePath, "")
+	if err == nil {
+		t.Fatal("Expected invalid settings file to cause an error")
+	}
+	if !strings.Contains(err.Error(), settingsFilePath) || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Expected error to tell file and line, but got '%v'", err)
+	}
+}
+
+func TestThatInvalidSettingsFailsStrictConfig(t *testing.T) {
+	settingsFilePath := "/tmp/settings5.toml"
+	ioutil.WriteFile(settingsFilePath, []byte("endpoint = \n"), 0600)
+
+	configFilePath := "/tmp/config12.conf"
+	configString := "[[plugin]]\nname = \"test-1\"\nbuiltin = \"router\"\nversion = \"1.0.0\"\nsettings_file = \"" + settingsFilePath + "\"\n"
+	ioutil.WriteFile(configFilePath, []byte(configString), 0600)
+
+	if _, err := NewStrictConfigFromTOMLFile(configFilePath); err == nil {
+		t.Error("Expected invalid settings file to fail strict config")
+	}
+
+	config, err := readConfigFromFile(configFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if NewHandler(config.PluginDefinitions()[0], config) != nil {
+		t.Error("Expected plugin with invalid settings not to be loaded")
+	}
+}
+
+func TestThatPluginWithInvalidSettingsIsNotLoaded(t *testing.T) {
+	pdef := newRouterDefinition("router-1", 1)
+	pdef.settingsErr = errors.New("settings file '/tmp/settings.toml': Near line 1")
+
+	if NewHandler(pdef, &defaultConfig{}) != nil {
+		t.Error("Expected handler with invalid settings not to be loaded")
+	}
+	if newWorker(pdef, &defaultConfig{}) != nil {
+		t.Error("Expected worker with invalid settings not to be loaded")
+	}
+}
+
+func TestThatOnlyHandlersSkippedForInvalidSettingsAreLoadedOnSettingsChange(t *testing.T) {
+	invalidSettings := newRouterDefinition("router-1", 1)
+	invalidSettings.settingsErr = errors.New("settings file '/tmp/settings.toml': Near line 1")
+	invalidRules := newRouterDefinition("router-2", 2)
+	invalidRules.RulesVal = []*ruleDefinition{{Route: "all", Regex: "("}}
+
+	config := &defaultConfig{Definitions: []*defaultPluginDefinition{invalidSettings, invalidRules}}
+	pool := newHandlerPoolFromConfig(config)
+	if len(pool()) != 0 {
+		t.Fatalf("Expected no handlers to be loaded, but got %d", len(pool()))
+	}
+
+	invalidSettings.setSettingsError(nil)
+	config.notify(&config.onSettingsChangeListeners, invalidSettings)
+	invalidRules.RulesVal = []*ruleDefinition{{Route: "all"}}
+	config.notify(&config.onSettingsChangeListeners, invalidRules)
+
+	handlers := pool()
+	if len(handlers) != 1 || handlers[0].definition.Name() != "router-1" {
+		t.Errorf("Expected only the handler skipped for invalid settings to be loaded, got %d handlers", len(handlers))
+	}
+}
+
+func TestThatInlineSettingsAreMergedWithSettingsFile(t *testing.T) {
+	settingsFilePath := "/tmp/settings6.toml"
+	ioutil.WriteFile(settingsFilePath, []byte("endpoint = \"http://remote\"\n\n[tls]\nenabled = true\n"), 0600)
+
+	configFilePath := "/tmp/config13.conf"
+	configString := "inherit_settings_from_env = true\n\n[[plugin]]\nname = \"test-1\"\npath = \"/tmp/test-1\"\nversion = \"1.0.0\"\nsettings_file = \"" + settingsFilePath + "\"\n\n[plugin.settings]\nendpoint = \"http://localhost\"\nbatch_size = 10\noverride-me = \"inline\"\n\n[plugin.settings.tls]\nenabled = false\nca_file = \"/etc/ca.pem\"\n"
+	ioutil.WriteFile(configFilePath, []byte(configString), 0600)
+	os.Setenv("OURETL_TEST_1_OVERRIDE_ME", "env")
+	defer os.Unsetenv("OURETL_TEST_1_OVERRIDE_ME")
+
+	config, err := readConfigFromFile(configFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings := config.PluginDefinitions()[0].Settings()
+	if value, _ := settings.Get("endpoint"); value != "http://remote" {
+		t.Errorf("Expected settings file to take precedence for 'endpoint', but got '%v'", value)
+	}
+	if value, _ := settings.Get("batch_size"); value != int64(10) {
+		t.Errorf("Expected inline setting 'batch_size' to be 10, but got '%v'", value)
+	}
+	if value, _ := settings.Get("override-me"); value != "env" {
+		t.Errorf("Expected environment to take precedence for 'override-me', but got '%v'", value)
+	}
+
+	tls, _ := settings.Get("tls")
+	if tls.(map[string]interface{})["enabled"] != true || tls.(map[string]interface{})["ca_file"] != "/etc/ca.pem" {
+		t.Errorf("Expected nested table 'tls' to be merged, but got '%v'", tls)
+	}
+}
+
+func TestThatChangedInlineSettingsAreReloaded(t *testing.T) {
+	current := newRouterDefinition("router-1", 1)
+	current.SettingsVal = map[string]interface{}{"key": "value"}
+	current.settings = &defaultPluginSettings{settings: map[string]interface{}{"key": "value"}}
+	config := &defaultConfig{Definitions: []*defaultPluginDefinition{current}}
+
+	called := false
+	config.OnPluginSettingsChanged(func(_ ouretl.PluginDefinition) {
+		called = true
+	})
+
+	next := newRouterDefinition("router-1", 1)
+	next.SettingsVal = map[string]interface{}{"key": "changed"}
+	config.reload(&defaultConfig{Definitions: []*defaultPluginDefinition{next}})
+
+	if !called {
+		t.Error("Expected settings change listener to be called")
+	}
+	if value, _ := current.Settings().Get("key"); value != "changed" {
+		t.Errorf("Expected setting 'key' to be 'changed', but got '%v'", value)
+	}
+}
+
+func TestThatEnvOverridesAreNamespacedByPlugin(t *testing.T) {
+	os.Setenv("OURETL_HTTP_WRITER_URL", "http://writer")
+	os.Setenv("CUSTOM_URL", "http://custom")
+	os.Setenv("url", "http://bare")
+	os.Setenv("URL", "http://upper")
+	defer os.Unsetenv("OURETL_HTTP_WRITER_URL")
+	defer os.Unsetenv("CUSTOM_URL")
+	defer os.Unsetenv("url")
+	defer os.Unsetenv("URL")
+
+	configFilePath := "/tmp/config14.conf"
+	configString := "inherit_settings_from_env = true\n\n[[plugin]]\nname = \"http-writer\"\nbuiltin = \"router\"\nversion = \"1.0.0\"\n\n[plugin.settings]\nurl = \"http://localhost\"\n\n[[plugin]]\nname = \"http-reader\"\nbuiltin = \"router\"\nversion = \"1.0.0\"\nenv_prefix = \"CUSTOM_\"\n\n[plugin.settings]\nurl = \"http://localhost\"\n\n[[plugin]]\nname = \"legacy\"\nbuiltin = \"router\"\nversion = \"1.0.0\"\nenv_prefix = \"\"\n\n[[plugin]]\nname = \"other\"\nbuiltin = \"router\"\nversion = \"1.0.0\"\n\n[plugin.settings]\nurl = \"http://localhost\"\n"
+	ioutil.WriteFile(configFilePath, []byte(configString), 0600)
+
+	config, err := readConfigFromFile(configFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"http-writer": "http://writer",
+		"http-reader": "http://custom",
+		"legacy":      "http://bare",
+		"other":       "http://localhost",
+	}
+	for _, pdef := range config.PluginDefinitions() {
+		if value, _ := pdef.Settings().Get("url"); value != expected[pdef.Name()] {
+			t.Errorf("Expected setting 'url' of plugin '%s' to be '%s', but got '%v'", pdef.Name(), expected[pdef.Name()], value)
+		}
+	}
+
+	overrides := config.definitions()[0].settings.overridden()
+	if overrides["url"] != "OURETL_HTTP_WRITER_URL" {
+		t.Errorf("Expected setting 'url' to be listed as overridden, but got %v", overrides)
+	}
+}
@@ -0,0 +1,117 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	ouretl "github.com/ourstudio-se/ouretl-abstractions"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	restartAlways    = "always"
+	restartOnFailure = "on-failure"
+	restartNever     = "never"
+
+	defaultRestartInitialBackoff = 1 * time.Second
+	defaultRestartMaxBackoff     = 1 * time.Minute
+)
+
+var errWorkerGaveUp = errors.New("worker exceeded its maximum number of restarts")
+
+type restartPolicy struct {
+	Policy         string   `toml:"policy" json:"policy" yaml:"policy"`
+	MaxRestarts    int      `toml:"max_restarts" json:"max_restarts" yaml:"max_restarts"`
+	InitialBackoff duration `toml:"initial_backoff" json:"initial_backoff" yaml:"initial_backoff"`
+	MaxBackoff     duration `toml:"max_backoff" json:"max_backoff" yaml:"max_backoff"`
+	ResetWindow    duration `toml:"reset_window" json:"reset_window" yaml:"reset_window"`
+}
+
+type restartPolicyDefinition interface {
+	restartPolicy() *restartPolicy
+}
+
+var defaultRestartPolicy = &restartPolicy{
+	Policy: restartOnFailure,
+}
+
+func restartPolicyFor(pdef ouretl.PluginDefinition) *restartPolicy {
+	if d, ok := pdef.(restartPolicyDefinition); ok && d.restartPolicy() != nil {
+		return d.restartPolicy()
+	}
+
+	return defaultRestartPolicy
+}
+
+func (rp *restartPolicy) shouldRestart(err error) bool {
+	switch rp.Policy {
+	case restartAlways:
+		return true
+	case restartNever:
+		return false
+	}
+
+	return err != nil
+}
+
+func (rp *restartPolicy) backoff(restart int) time.Duration {
+	initial := rp.InitialBackoff.Duration
+	if initial <= 0 {
+		initial = defaultRestartInitialBackoff
+	}
+	max := rp.MaxBackoff.Duration
+	if max <= 0 {
+		max = defaultRestartMaxBackoff
+	}
+
+	return exponentialBackoff(initial, max, 0, restart)
+}
+
+// initiateWorker runs a worker and restarts it according to the restart
+// policy, until ctx is done or the policy tells it to stop. It returns
+// nil when stopped through ctx, and otherwise the reason the worker
+// was given up on.
+func initiateWorker(ctx context.Context, worker HeaderWorkerPlugin, proxy func(context.Context, []byte, map[string]string), name string, rp *restartPolicy) error {
+	restarts := 0
+	for {
+		startedAt := time.Now()
+		err := worker.Start(ctx, proxy)
+		if ctx.Err() != nil {
+			log.Infof("WorkerPlugin '%s' has been stopped", name)
+			return nil
+		}
+
+		if err != nil {
+			log.Errorf("WorkerPlugin '%s' has exited with error: %v", name, err)
+		} else {
+			log.Warnf("WorkerPlugin '%s' has exited without error", name)
+		}
+
+		if !rp.shouldRestart(err) {
+			if err == nil {
+				err = errors.New("worker exited")
+			}
+			return err
+		}
+
+		if rp.ResetWindow.Duration > 0 && time.Since(startedAt) >= rp.ResetWindow.Duration {
+			restarts = 0
+		}
+		if rp.MaxRestarts > 0 && restarts >= rp.MaxRestarts {
+			log.Errorf("WorkerPlugin '%s' has been restarted %d times, giving up", name, restarts)
+			return errWorkerGaveUp
+		}
+
+		restarts = restarts + 1
+		wait := rp.backoff(restarts)
+		log.Infof("Restarting worker '%s' in %v (restart %d)...", name, wait, restarts)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			log.Infof("WorkerPlugin '%s' has been stopped", name)
+			return nil
+		}
+	}
+}
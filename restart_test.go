@@ -0,0 +1,321 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+type mockWorkerImpl struct {
+	starts int
+	err    error
+	block  bool
+}
+
+func (m *mockWorkerImpl) Start(ctx context.Context, _ func(context.Context, []byte)) error {
+	m.starts = m.starts + 1
+	if m.block {
+		<-ctx.Done()
+		return nil
+	}
+
+	return m.err
+}
+
+func TestThatWorkerGivesUpAfterMaxRestarts(t *testing.T) {
+	worker := &mockWorkerImpl{err: errors.New("connection refused")}
+	rp := &restartPolicy{Policy: restartOnFailure, MaxRestarts: 2, InitialBackoff: duration{time.Millisecond}}
+
+	err := initiateWorker(context.Background(), &contextWorker{worker: worker}, nil, "worker", rp)
+	if err != errWorkerGaveUp {
+		t.Errorf("Expected error '%v' but got '%v'", errWorkerGaveUp, err)
+	}
+	if worker.starts != 3 {
+		t.Errorf("Expected worker to be started 3 times, but was started %d times", worker.starts)
+	}
+}
+
+func TestThatWorkerIsNotRestartedWithPolicyNever(t *testing.T) {
+	worker := &mockWorkerImpl{err: errors.New("connection refused")}
+	rp := &restartPolicy{Policy: restartNever}
+
+	err := initiateWorker(context.Background(), &contextWorker{worker: worker}, nil, "worker", rp)
+	if err == nil {
+		t.Error("Expected terminal error from worker")
+	}
+	if worker.starts != 1 {
+		t.Errorf("Expected worker to be started once, but was started %d times", worker.starts)
+	}
+}
+
+func TestThatWorkerExitingCleanlyIsRestartedWithPolicyAlways(t *testing.T) {
+	worker := &mockWorkerImpl{}
+	rp := &restartPolicy{Policy: restartAlways, MaxRestarts: 1, InitialBackoff: duration{time.Millisecond}}
+
+	_ = initiateWorker(context.Background(), &contextWorker{worker: worker}, nil, "worker", rp)
+	if worker.starts != 2 {
+		t.Errorf("Expected worker to be started twice, but was started %d times", worker.starts)
+	}
+}
+
+func TestThatStoppedWorkerIsNotReportedAsFailed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	worker := &mockWorkerImpl{block: true}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	err := initiateWorker(ctx, &contextWorker{worker: worker}, nil, "worker", defaultRestartPolicy)
+	if err != nil {
+		t.Errorf("Expected no error from stopped worker, but got '%v'", err)
+	}
+}
+
+func TestThatWorkerPoolReportsWhenAllWorkersHaveStopped(t *testing.T) {
+	exhausted := false
+	pool := &workerPool{onExhausted: func() {
+		exhausted = true
+	}}
+
+	w1 := &runningWorker{definition: &defaultPluginDefinition{NameVal: "worker-1"}}
+	w2 := &runningWorker{definition: &defaultPluginDefinition{NameVal: "worker-2"}}
+	pool.started(w1)
+	pool.started(w2)
+
+	pool.exited(w1, errWorkerGaveUp)
+	if exhausted {
+		t.Error("Worker pool reported exhaustion while a worker is still running")
+	}
+
+	pool.exited(w2, errWorkerGaveUp)
+	if !exhausted {
+		t.Error("Worker pool did not report exhaustion when all workers stopped")
+	}
+}
+
+func TestThatWorkerPoolReportsWhenLastWorkerExitsWithoutError(t *testing.T) {
+	exhausted := false
+	pool := &workerPool{onExhausted: func() {
+		exhausted = true
+	}}
+
+	w1 := &runningWorker{definition: &defaultPluginDefinition{NameVal: "worker-1"}}
+	pool.started(w1)
+
+	pool.exited(w1, nil)
+	if !exhausted {
+		t.Error("Worker pool did not report exhaustion when the last worker exited without an error")
+	}
+}
+
+func TestThatRuntimeReportsExhaustionWhenNoWorkerStarted(t *testing.T) {
+	rt := NewRuntime(newDefaultConfig())
+	if err := rt.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer rt.Shutdown(context.Background())
+
+	select {
+	case <-rt.WorkersExhausted():
+	case <-time.After(time.Second):
+		t.Error("Expected runtime without workers to report exhaustion")
+	}
+}
+
+func TestThatReadConfigParsesRestartPolicy(t *testing.T) {
+	configFilePath := "/tmp/config5.conf"
+	configString := "[[plugin]]\nname = \"test-1\"\npath = \"/tmp/test-1\"\nversion = \"1.0.0\"\n\n[plugin.restart]\npolicy = \"always\"\nmax_restarts = 10\nreset_window = \"5m\"\n\n[[plugin]]\nname = \"test-2\"\npath = \"/tmp/test-2\"\nversion = \"1.0.0\"\n"
+	ioutil.WriteFile(configFilePath, []byte(configString), 0600)
+
+	config, err := readConfigFromFile(configFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rp := restartPolicyFor(config.PluginDefinitions()[0])
+	if rp.Policy != restartAlways || rp.MaxRestarts != 10 || rp.ResetWindow.Duration != 5*time.Minute {
+		t.Errorf("Restart policy did not match config, got %+v", rp)
+	}
+	if restartPolicyFor(config.PluginDefinitions()[1]) != defaultRestartPolicy {
+		t.Error("Plugin without restart block did not get the default restart policy")
+	}
+}
+
+type mockStoppableWorkerImpl struct {
+	stopped chan struct{}
+	publish func(context.Context, []byte)
+}
+
+func (m *mockStoppableWorkerImpl) Start(ctx context.Context, target func(context.Context, []byte)) error {
+	m.publish = target
+	<-m.stopped
+	return nil
+}
+
+func (m *mockStoppableWorkerImpl) Stop() error {
+	close(m.stopped)
+	return nil
+}
+
+func TestThatDeactivatedWorkerIsStopped(t *testing.T) {
+	exhausted := false
+	pool := &workerPool{onExhausted: func() {
+		exhausted = true
+	}}
+
+	published := 0
+	publish := func(context.Context, *DefaultDataMessage) {
+		published = published + 1
+	}
+
+	worker := &mockStoppableWorkerImpl{stopped: make(chan struct{})}
+	pdef := &defaultPluginDefinition{NameVal: "worker-1", VersionVal: "1.0.0"}
+	startWorker(context.Background(), pool, &contextWorker{worker: worker}, publish, pdef)
+
+	time.Sleep(10 * time.Millisecond)
+	if !pool.isRunning(pdef) {
+		t.Fatal("Expected worker to be running")
+	}
+
+	if !pool.stop(pdef) {
+		t.Fatal("Expected running worker to be stopped")
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if pool.isRunning(pdef) {
+		t.Error("Expected worker to no longer be running after being stopped")
+	}
+	if exhausted {
+		t.Error("Expected a stopped worker not to be reported as terminally stopped")
+	}
+
+	worker.publish(context.Background(), []byte("late"))
+	if published != 0 {
+		t.Errorf("Expected messages published after stop to be dropped, but %d were published", published)
+	}
+}
+
+func TestThatRestartedWorkerIsListedOnce(t *testing.T) {
+	pool := &workerPool{}
+	publish := func(context.Context, *DefaultDataMessage) {}
+	pdef := &defaultPluginDefinition{NameVal: "worker-1", VersionVal: "1.0.0"}
+
+	startWorker(context.Background(), pool, &contextWorker{worker: &mockStoppableWorkerImpl{stopped: make(chan struct{})}}, publish, pdef)
+	pool.stop(pdef)
+	startWorker(context.Background(), pool, &contextWorker{worker: &mockStoppableWorkerImpl{stopped: make(chan struct{})}}, publish, pdef)
+
+	if sources := pool.sources(); len(sources) != 1 || sources[0] != "worker-1" {
+		t.Errorf("Expected restarted worker to be listed once, but got %v", sources)
+	}
+
+	pool.stop(pdef)
+	if sources := pool.sources(); len(sources) != 0 {
+		t.Errorf("Expected stopped worker not to be listed, but got %v", sources)
+	}
+}
+
+type mockLegacyWorkerImpl struct {
+	started  chan struct{}
+	released chan struct{}
+	publish  func(context.Context, []byte)
+}
+
+func newMockLegacyWorkerImpl() *mockLegacyWorkerImpl {
+	return &mockLegacyWorkerImpl{started: make(chan struct{}), released: make(chan struct{})}
+}
+
+func (m *mockLegacyWorkerImpl) Start(_ context.Context, target func(context.Context, []byte)) error {
+	m.publish = target
+	close(m.started)
+	<-m.released
+	return nil
+}
+
+func TestThatWorkerWithoutStopCanBeStartedAgain(t *testing.T) {
+	pool := &workerPool{}
+
+	var mu sync.Mutex
+	var published []string
+	publish := func(_ context.Context, dm *DefaultDataMessage) {
+		mu.Lock()
+		published = append(published, string(dm.Data()))
+		mu.Unlock()
+	}
+
+	pdef := &defaultPluginDefinition{NameVal: "worker-1", VersionVal: "1.0.0"}
+	first := newMockLegacyWorkerImpl()
+	defer close(first.released)
+	startWorker(context.Background(), pool, &contextWorker{worker: first}, publish, pdef)
+	<-first.started
+
+	if !pool.stop(pdef) {
+		t.Fatal("Expected running worker to be stopped")
+	}
+	if pool.isRunning(pdef) {
+		t.Fatal("Expected worker without `Stop` to no longer be running after being stopped")
+	}
+
+	second := newMockLegacyWorkerImpl()
+	defer close(second.released)
+	startWorker(context.Background(), pool, &contextWorker{worker: second}, publish, pdef)
+	<-second.started
+
+	first.publish(context.Background(), []byte("stopped"))
+	second.publish(context.Background(), []byte("started"))
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(published) != 1 || published[0] != "started" {
+		t.Errorf("Expected only the worker started again to publish, got %v", published)
+	}
+}
+
+func TestThatWorkerWithoutStopIsDetected(t *testing.T) {
+	if stopperFor(&contextWorker{worker: &mockWorkerImpl{}}) != nil {
+		t.Error("Expected worker without `Stop` not to be stoppable")
+	}
+	if stopperFor(&contextWorker{worker: &mockStoppableWorkerImpl{}}) == nil {
+		t.Error("Expected worker with `Stop` to be stoppable")
+	}
+}
+
+func TestThatWorkersCanBeStoppedAndStartedConcurrently(t *testing.T) {
+	pool := &workerPool{}
+	publish := func(context.Context, *DefaultDataMessage) {}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			pdef := &defaultPluginDefinition{NameVal: fmt.Sprintf("worker-%d", i), VersionVal: "1.0.0"}
+			for j := 0; j < 20; j++ {
+				startWorker(context.Background(), pool, &contextWorker{worker: &mockWorkerImpl{block: true}}, publish, pdef)
+				pool.stop(pdef)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 4; i++ {
+		pdef := &defaultPluginDefinition{NameVal: fmt.Sprintf("worker-%d", i), VersionVal: "1.0.0"}
+		if pool.isRunning(pdef) {
+			t.Errorf("Expected 'worker-%d' to be stopped after its last stop", i)
+		}
+	}
+
+	startWorker(context.Background(), pool, &contextWorker{worker: &mockWorkerImpl{block: true}}, publish, &defaultPluginDefinition{NameVal: "worker-0", VersionVal: "1.0.0"})
+	pool.stopAll()
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if len(pool.workers) != 0 {
+		t.Errorf("Expected no workers after stopping all, but got %d", len(pool.workers))
+	}
+}
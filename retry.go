@@ -0,0 +1,104 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"math/rand"
+	"time"
+
+	ouretl "github.com/ourstudio-se/ouretl-abstractions"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultInitialBackoff = 100 * time.Millisecond
+	defaultMaxBackoff     = 10 * time.Second
+)
+
+var handlerRetries = expvar.NewMap("ouretl_handler_retries")
+
+type retryPolicy struct {
+	MaxAttempts    int      `toml:"max_attempts" json:"max_attempts" yaml:"max_attempts"`
+	InitialBackoff duration `toml:"initial_backoff" json:"initial_backoff" yaml:"initial_backoff"`
+	MaxBackoff     duration `toml:"max_backoff" json:"max_backoff" yaml:"max_backoff"`
+	Jitter         float64  `toml:"jitter" json:"jitter" yaml:"jitter"`
+}
+
+type retryPolicyDefinition interface {
+	retryPolicy() *retryPolicy
+}
+
+func retryPolicyFor(pdef ouretl.PluginDefinition) *retryPolicy {
+	if d, ok := pdef.(retryPolicyDefinition); ok {
+		return d.retryPolicy()
+	}
+
+	return nil
+}
+
+// backoff returns the time to wait before the given attempt, where the
+// first retry is attempt 1.
+func (rp *retryPolicy) backoff(attempt int) time.Duration {
+	return exponentialBackoff(rp.InitialBackoff.Duration, rp.MaxBackoff.Duration, rp.Jitter, attempt)
+}
+
+// exponentialBackoff doubles the initial wait for each attempt, caps it
+// at max, and reduces it by a random fraction of at most jitter.
+func exponentialBackoff(initial, max time.Duration, jitter float64, attempt int) time.Duration {
+	if initial <= 0 {
+		initial = defaultInitialBackoff
+	}
+	if max <= 0 {
+		max = defaultMaxBackoff
+	}
+
+	d := initial
+	for i := 1; i < attempt && d < max; i++ {
+		d = d * 2
+	}
+	if d > max {
+		d = max
+	}
+
+	if jitter > 0 {
+		if jitter > 1 {
+			jitter = 1
+		}
+		d = d - time.Duration(rand.Float64()*jitter*float64(d))
+	}
+
+	return d
+}
+
+// withRetry calls fn until it succeeds, the policy runs out of attempts
+// or ctx is done. Once the handler has passed the message on, its errors
+// are returned as is, since they may come from handlers further down the
+// chain, and retrying would re-run every one of them.
+func withRetry(ctx context.Context, rp *retryPolicy, w *wrapper, dm ouretl.DataMessage, forwarded func() bool, fn func() error) error {
+	err := fn()
+	if rp == nil || rp.MaxAttempts < 2 {
+		return err
+	}
+
+	for attempt := 1; attempt < rp.MaxAttempts && err != nil; attempt++ {
+		var he *handlerError
+		if errors.As(err, &he) || forwarded() {
+			return err
+		}
+
+		wait := rp.backoff(attempt)
+		log.Warnf("DataHandlerPlugin '%s (v%s)' failed on message with ID '%s' (attempt %d of %d), retrying in %v: %v", w.definition.Name(), w.definition.Version(), dm.ID(), attempt, rp.MaxAttempts, wait, err)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+
+		handlerRetries.Add(w.definition.Name(), 1)
+		err = fn()
+	}
+
+	return err
+}
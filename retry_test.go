@@ -0,0 +1,161 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	ouretl "github.com/ourstudio-se/ouretl-abstractions"
+)
+
+type mockFlakyPluginImpl struct {
+	failures int
+	calls    int
+}
+
+func (m *mockFlakyPluginImpl) Handle(dm ouretl.DataMessage, next func([]byte) error) error {
+	m.calls = m.calls + 1
+	if m.calls <= m.failures {
+		return errors.New("transient failure")
+	}
+
+	return next(dm.Data())
+}
+
+func TestThatFailingHandlerIsRetriedAccordingToPolicy(t *testing.T) {
+	impl := &mockFlakyPluginImpl{failures: 2}
+	p1 := &wrapper{
+		definition: &defaultPluginDefinition{
+			NameVal:  "flaky",
+			isActive: true,
+			RetryVal: &retryPolicy{MaxAttempts: 3, InitialBackoff: duration{time.Millisecond}},
+		},
+		implementation: impl,
+	}
+
+	err := proxyDataMessage(context.Background(), []*wrapper{p1}, &DefaultDataMessage{id: "test", data: []byte("test")})
+	if err != nil {
+		t.Error(err)
+	}
+	if impl.calls != 3 {
+		t.Errorf("Expected 3 calls to flaky handler, but got %d", impl.calls)
+	}
+}
+
+func TestThatHandlerGivesUpAfterMaxAttempts(t *testing.T) {
+	impl := &mockFlakyPluginImpl{failures: 5}
+	p1 := &wrapper{
+		definition: &defaultPluginDefinition{
+			NameVal:  "flaky",
+			isActive: true,
+			RetryVal: &retryPolicy{MaxAttempts: 2, InitialBackoff: duration{time.Millisecond}},
+		},
+		implementation: impl,
+	}
+
+	err := proxyDataMessage(context.Background(), []*wrapper{p1}, &DefaultDataMessage{id: "test", data: []byte("test")})
+	if err == nil {
+		t.Error("Expected an error after running out of attempts")
+	}
+	if impl.calls != 2 {
+		t.Errorf("Expected 2 calls to flaky handler, but got %d", impl.calls)
+	}
+}
+
+func TestThatDownstreamErrorsAreNotRetried(t *testing.T) {
+	upstream := &mockFlakyPluginImpl{}
+	p1 := &wrapper{
+		definition: &defaultPluginDefinition{
+			NameVal:  "upstream",
+			isActive: true,
+			RetryVal: &retryPolicy{MaxAttempts: 3, InitialBackoff: duration{time.Millisecond}},
+		},
+		implementation: upstream,
+	}
+	p2 := &wrapper{
+		definition:     &defaultPluginDefinition{NameVal: "downstream", isActive: true},
+		implementation: &mockFailingPluginImpl{err: errors.New("permanent failure")},
+	}
+
+	err := proxyDataMessage(context.Background(), []*wrapper{p1, p2}, &DefaultDataMessage{id: "test", data: []byte("test")})
+	if err == nil {
+		t.Error("Expected downstream error to be returned")
+	}
+	if upstream.calls != 1 {
+		t.Errorf("Expected upstream handler to be called once, but got %d", upstream.calls)
+	}
+}
+
+type mockWrappingPluginImpl struct {
+	calls int
+}
+
+func (m *mockWrappingPluginImpl) Handle(dm ouretl.DataMessage, next func([]byte) error) error {
+	m.calls = m.calls + 1
+	if err := next(dm.Data()); err != nil {
+		return fmt.Errorf("passing on message: %v", err)
+	}
+
+	return nil
+}
+
+func TestThatWrappedDownstreamErrorsAreNotRetried(t *testing.T) {
+	upstream := &mockWrappingPluginImpl{}
+	p1 := &wrapper{
+		definition: &defaultPluginDefinition{
+			NameVal:  "upstream",
+			isActive: true,
+			RetryVal: &retryPolicy{MaxAttempts: 3, InitialBackoff: duration{time.Millisecond}},
+		},
+		implementation: upstream,
+	}
+	downstream := &mockFlakyPluginImpl{failures: 1}
+	p2 := &wrapper{
+		definition:     &defaultPluginDefinition{NameVal: "downstream", isActive: true},
+		implementation: downstream,
+	}
+
+	err := proxyDataMessage(context.Background(), []*wrapper{p1, p2}, &DefaultDataMessage{id: "test", data: []byte("test")})
+	if err == nil {
+		t.Error("Expected downstream error to be returned")
+	}
+	if upstream.calls != 1 {
+		t.Errorf("Expected upstream handler to be called once, but got %d", upstream.calls)
+	}
+	if downstream.calls != 1 {
+		t.Errorf("Expected downstream handler to be called once, but got %d", downstream.calls)
+	}
+}
+
+func TestThatBackoffGrowsExponentiallyUpToMax(t *testing.T) {
+	rp := &retryPolicy{InitialBackoff: duration{10 * time.Millisecond}, MaxBackoff: duration{50 * time.Millisecond}}
+
+	expected := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 50 * time.Millisecond, 50 * time.Millisecond}
+	for i, e := range expected {
+		if b := rp.backoff(i + 1); b != e {
+			t.Errorf("Expected backoff %v for attempt %d, but got %v", e, i+1, b)
+		}
+	}
+}
+
+func TestThatReadConfigParsesRetryPolicy(t *testing.T) {
+	configFilePath := "/tmp/config4.conf"
+	configString := "[[plugin]]\nname = \"test-1\"\npath = \"/tmp/test-1\"\nversion = \"1.0.0\"\n\n[plugin.retry]\nmax_attempts = 5\ninitial_backoff = \"200ms\"\nmax_backoff = \"5s\"\njitter = 0.2\n"
+	ioutil.WriteFile(configFilePath, []byte(configString), 0600)
+
+	config, err := readConfigFromFile(configFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rp := retryPolicyFor(config.PluginDefinitions()[0])
+	if rp == nil {
+		t.Fatal("Retry policy was not read from config")
+	}
+	if rp.MaxAttempts != 5 || rp.InitialBackoff.Duration != 200*time.Millisecond || rp.MaxBackoff.Duration != 5*time.Second || rp.Jitter != 0.2 {
+		t.Errorf("Retry policy did not match config, got %+v", rp)
+	}
+}
@@ -0,0 +1,242 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	ouretl "github.com/ourstudio-se/ouretl-abstractions"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	builtinRouter = "router"
+
+	// RouteHeader is the message header a built-in router sets to the
+	// name of the route a message matched.
+	RouteHeader = "ouretl-route"
+)
+
+type ruleDefinition struct {
+	Route    string `toml:"route" json:"route" yaml:"route"`
+	JSONPath string `toml:"json_path" json:"json_path" yaml:"json_path"`
+	Header   string `toml:"header" json:"header" yaml:"header"`
+	Regex    string `toml:"regex" json:"regex" yaml:"regex"`
+	Equals   string `toml:"equals" json:"equals" yaml:"equals"`
+}
+
+type builtinDefinition interface {
+	builtin() string
+	rules() []*ruleDefinition
+}
+
+type routeDefinition interface {
+	routes() []string
+}
+
+func builtinFor(pdef ouretl.PluginDefinition) string {
+	if d, ok := pdef.(builtinDefinition); ok {
+		return d.builtin()
+	}
+
+	return ""
+}
+
+func rulesFor(pdef ouretl.PluginDefinition) []*ruleDefinition {
+	if d, ok := pdef.(builtinDefinition); ok {
+		return d.rules()
+	}
+
+	return nil
+}
+
+func routesFor(pdef ouretl.PluginDefinition) []string {
+	if d, ok := pdef.(routeDefinition); ok {
+		return d.routes()
+	}
+
+	return nil
+}
+
+type rule struct {
+	route    string
+	jsonPath []string
+	header   string
+	regex    *regexp.Regexp
+	equals   string
+}
+
+// matches tells if all conditions of the rule hold for the message. A
+// rule without conditions matches every message, and can be used as a
+// fallback route after more specific rules.
+func (r *rule) matches(dm HeaderedDataMessage) bool {
+	var value string
+	var found bool
+
+	switch {
+	case r.header != "":
+		value, found = dm.Header(r.header)
+	case r.jsonPath != nil:
+		value, found = lookupJSONPath(dm.Data(), r.jsonPath)
+	default:
+		value, found = string(dm.Data()), true
+	}
+
+	if !found {
+		return false
+	}
+	if r.regex != nil && !r.regex.MatchString(value) {
+		return false
+	}
+	if r.equals != "" && value != r.equals {
+		return false
+	}
+
+	return true
+}
+
+type router struct {
+	rules []*rule
+}
+
+func newRouter(defs []*ruleDefinition) (*router, error) {
+	var rules []*rule
+	for i, def := range defs {
+		if def.Route == "" {
+			return nil, fmt.Errorf("router rule %d has no route", i+1)
+		}
+
+		r := &rule{
+			route:  def.Route,
+			header: def.Header,
+			equals: def.Equals,
+		}
+
+		if def.JSONPath != "" {
+			if def.Header != "" {
+				return nil, fmt.Errorf("router rule for route '%s' cannot match both `json_path` and `header`", def.Route)
+			}
+			r.jsonPath = parseJSONPath(def.JSONPath)
+		}
+
+		if def.Regex != "" {
+			regex, err := regexp.Compile(def.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("router rule for route '%s' has an invalid regex: %v", def.Route, err)
+			}
+			r.regex = regex
+		}
+
+		rules = append(rules, r)
+	}
+
+	return &router{rules: rules}, nil
+}
+
+// Handle tags the message with the route of the first matching rule,
+// through the RouteHeader header, and passes it on unchanged.
+func (r *router) Handle(ctx context.Context, dm ouretl.DataMessage, next func(context.Context, []byte) error) error {
+	hdm, ok := dm.(HeaderedDataMessage)
+	if !ok {
+		return next(ctx, dm.Data())
+	}
+
+	for _, rule := range r.rules {
+		if rule.matches(hdm) {
+			hdm.SetHeader(RouteHeader, rule.route)
+			log.Debugf("Message with ID '%s' routed to '%s'", dm.ID(), rule.route)
+			break
+		}
+	}
+
+	return next(ctx, dm.Data())
+}
+
+func newBuiltinHandler(definition ouretl.PluginDefinition) *wrapper {
+	d, ok := definition.(builtinDefinition)
+	if !ok || d.builtin() != builtinRouter {
+		log.Errorf("Plugin '%s (v%s)' refers to unknown built-in '%s' -- it will be excluded from messaging pipeline", definition.Name(), definition.Version(), builtinFor(definition))
+		return nil
+	}
+
+	r, err := newRouter(d.rules())
+	if err != nil {
+		log.Errorf("Plugin '%s (v%s)' could not be loaded as a built-in router: %v", definition.Name(), definition.Version(), err)
+		return nil
+	}
+
+	log.Infof("Plugin '%s (v%s)' successfully loaded as a built-in router", definition.Name(), definition.Version())
+
+	return &wrapper{
+		definition:            definition,
+		contextImplementation: r,
+	}
+}
+
+// parseJSONPath splits a simple JSONPath expression such as
+// `$.order.items[0].type` into its field names and array indexes.
+func parseJSONPath(path string) []string {
+	path = strings.TrimPrefix(path, "$")
+	path = strings.Replace(path, "[", ".", -1)
+	path = strings.Replace(path, "]", "", -1)
+
+	var segments []string
+	for _, segment := range strings.Split(path, ".") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+
+	return segments
+}
+
+// lookupJSONPath returns the value at path as a string. Numbers are
+// returned as written, so that `1000000` is not read as `1e+06`.
+func lookupJSONPath(data []byte, path []string) (string, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return "", false
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return "", false
+	}
+
+	for _, segment := range path {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			next, ok := v[segment]
+			if !ok {
+				return "", false
+			}
+			value = next
+		case []interface{}:
+			i, err := strconv.Atoi(segment)
+			if err != nil || i < 0 || i >= len(v) {
+				return "", false
+			}
+			value = v[i]
+		default:
+			return "", false
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case nil:
+		return "null", true
+	case map[string]interface{}, []interface{}:
+		encoded, _ := json.Marshal(v)
+		return string(encoded), true
+	}
+
+	return fmt.Sprint(value), true
+}
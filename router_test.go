@@ -0,0 +1,97 @@
+package core
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+
+	ouretl "github.com/ourstudio-se/ouretl-abstractions"
+)
+
+func TestThatRouterSendsMessagesToMatchingRoute(t *testing.T) {
+	configFilePath := "/tmp/config7.conf"
+	configString := "[[plugin]]\nname = \"type-router\"\nbuiltin = \"router\"\nversion = \"1.0.0\"\npriority = 1\n\n[[plugin.rule]]\nroute = \"orders\"\njson_path = \"$.type\"\nequals = \"order\"\n\n[[plugin.rule]]\nroute = \"other\"\n"
+	ioutil.WriteFile(configFilePath, []byte(configString), 0600)
+
+	config, err := readConfigFromFile(configFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := NewHandler(config.PluginDefinitions()[0], config)
+	if router == nil {
+		t.Fatal("Built-in router could not be loaded from config")
+	}
+
+	var orders, other []string
+	pool := []*wrapper{
+		router,
+		{
+			definition: &defaultPluginDefinition{NameVal: "orders-sink", RoutesVal: []string{"orders"}, isActive: true},
+			implementation: &mockDataRecorder{record: func(dm ouretl.DataMessage) {
+				orders = append(orders, dm.ID())
+			}},
+		},
+		{
+			definition: &defaultPluginDefinition{NameVal: "other-sink", RoutesVal: []string{"other"}, isActive: true},
+			implementation: &mockDataRecorder{record: func(dm ouretl.DataMessage) {
+				other = append(other, dm.ID())
+			}},
+		},
+	}
+
+	_ = proxyDataMessage(context.Background(), pool, &DefaultDataMessage{id: "1", data: []byte(`{"type":"order"}`)})
+	_ = proxyDataMessage(context.Background(), pool, &DefaultDataMessage{id: "2", data: []byte(`{"type":"refund"}`)})
+	_ = proxyDataMessage(context.Background(), pool, &DefaultDataMessage{id: "3", data: []byte(`not json`)})
+
+	if len(orders) != 1 || orders[0] != "1" {
+		t.Errorf("Expected only message '1' to be routed to orders, got %v", orders)
+	}
+	if len(other) != 2 || other[0] != "2" || other[1] != "3" {
+		t.Errorf("Expected messages '2' and '3' to be routed to other, got %v", other)
+	}
+}
+
+func TestThatRouterRulesMatchPayloadAndHeaders(t *testing.T) {
+	r, err := newRouter([]*ruleDefinition{
+		{Route: "json", Header: "content-type", Equals: "application/json"},
+		{Route: "events", Regex: "^EVT"},
+		{Route: "nested", JSONPath: "$.order.items[1].sku", Equals: "B-2"},
+		{Route: "large", JSONPath: "$.n", Equals: "1000000"},
+		{Route: "decimal", JSONPath: "$.price", Equals: "19.99"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		dm       *DefaultDataMessage
+		expected string
+	}{
+		{&DefaultDataMessage{data: []byte("x"), headers: map[string]string{"content-type": "application/json"}}, "json"},
+		{&DefaultDataMessage{data: []byte("EVT-123")}, "events"},
+		{&DefaultDataMessage{data: []byte(`{"order":{"items":[{"sku":"A-1"},{"sku":"B-2"}]}}`)}, "nested"},
+		{&DefaultDataMessage{data: []byte(`{"n":1000000}`)}, "large"},
+		{&DefaultDataMessage{data: []byte(`{"price":19.99}`)}, "decimal"},
+		{&DefaultDataMessage{data: []byte("nothing")}, ""},
+	}
+
+	for _, c := range cases {
+		var route string
+		_ = r.Handle(context.Background(), c.dm, func(_ context.Context, _ []byte) error {
+			route, _ = c.dm.Header(RouteHeader)
+			return nil
+		})
+
+		if route != c.expected {
+			t.Errorf("Expected message '%s' to be routed to '%s', got '%s'", string(c.dm.Data()), c.expected, route)
+		}
+	}
+}
+
+func TestThatRouterWithInvalidRegexIsRejected(t *testing.T) {
+	_, err := newRouter([]*ruleDefinition{{Route: "broken", Regex: "("}})
+	if err == nil {
+		t.Error("Router rule with an invalid regex was not rejected")
+	}
+}
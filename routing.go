@@ -0,0 +1,72 @@
+package core
+
+import ouretl "github.com/ourstudio-se/ouretl-abstractions"
+
+type routingDefinition interface {
+	sources() []string
+	pipelineName() string
+}
+
+func sourcesFor(pdef ouretl.PluginDefinition) []string {
+	if d, ok := pdef.(routingDefinition); ok {
+		return d.sources()
+	}
+
+	return nil
+}
+
+func pipelineNameFor(pdef ouretl.PluginDefinition) string {
+	if d, ok := pdef.(routingDefinition); ok {
+		return d.pipelineName()
+	}
+
+	return ""
+}
+
+// acceptsMessage tells if a `DataHandlerPlugin` should handle a message.
+// It does if the message matches both its sources and its routes.
+func acceptsMessage(pdef ouretl.PluginDefinition, dm *DefaultDataMessage) bool {
+	return acceptsSource(pdef, dm) && acceptsRoute(pdef, dm)
+}
+
+// acceptsSource tells if a message was published by one of the sources
+// of a `DataHandlerPlugin`, where a source is either the worker that
+// published the message or the named pipeline that worker belongs to.
+// A plugin without sources accepts messages from every worker.
+func acceptsSource(pdef ouretl.PluginDefinition, dm *DefaultDataMessage) bool {
+	sources := sourcesFor(pdef)
+	if len(sources) == 0 {
+		return true
+	}
+
+	for _, source := range sources {
+		if source == dm.Origin() || (dm.pipeline != "" && source == dm.pipeline) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// acceptsRoute tells if a message has been routed by a built-in router
+// to one of the routes of a `DataHandlerPlugin`. A plugin without routes
+// accepts every message.
+func acceptsRoute(pdef ouretl.PluginDefinition, dm *DefaultDataMessage) bool {
+	routes := routesFor(pdef)
+	if len(routes) == 0 {
+		return true
+	}
+
+	route, ok := dm.Header(RouteHeader)
+	if !ok {
+		return false
+	}
+
+	for _, r := range routes {
+		if r == route {
+			return true
+		}
+	}
+
+	return false
+}
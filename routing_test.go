@@ -0,0 +1,81 @@
+package core
+
+import (
+	"context"
+	"testing"
+
+	ouretl "github.com/ourstudio-se/ouretl-abstractions"
+)
+
+func newRoutedWrapper(name string, sources []string, record func(ouretl.DataMessage)) *wrapper {
+	return &wrapper{
+		definition:     &defaultPluginDefinition{NameVal: name, SourcesVal: sources, isActive: true},
+		implementation: &mockDataRecorder{record: record},
+	}
+}
+
+func TestThatMessagesAreRoutedBySource(t *testing.T) {
+	var handled []string
+	record := func(name string) func(ouretl.DataMessage) {
+		return func(_ ouretl.DataMessage) {
+			handled = append(handled, name)
+		}
+	}
+
+	pool := []*wrapper{
+		newRoutedWrapper("orders-transform", []string{"orders-reader"}, record("orders-transform")),
+		newRoutedWrapper("users-transform", []string{"users-reader"}, record("users-transform")),
+		newRoutedWrapper("audit-log", nil, record("audit-log")),
+	}
+
+	_ = proxyDataMessage(context.Background(), pool, &DefaultDataMessage{id: "test", data: []byte("test"), origin: "users-reader"})
+
+	if len(handled) != 2 || handled[0] != "users-transform" || handled[1] != "audit-log" {
+		t.Errorf("Expected message to be handled by 'users-transform' and 'audit-log', got %v", handled)
+	}
+}
+
+func TestThatMessagesAreRoutedByNamedPipeline(t *testing.T) {
+	handled := false
+	pool := []*wrapper{
+		newRoutedWrapper("orders-sink", []string{"orders"}, func(_ ouretl.DataMessage) {
+			handled = true
+		}),
+	}
+
+	var published *DefaultDataMessage
+	proxy := newMessageProxy(func(_ context.Context, dm *DefaultDataMessage) {
+		published = dm
+	}, "orders-reader", "orders")
+	proxy(context.Background(), []byte("test"), nil)
+
+	_ = proxyDataMessage(context.Background(), pool, published)
+
+	if !handled {
+		t.Error("Message from a worker in the 'orders' pipeline did not reach its handler")
+	}
+}
+
+func TestThatPipelineStageEndsBranchForOtherSources(t *testing.T) {
+	p, err := newPipeline([]*stageDefinition{
+		{Name: "orders-transform", Plugin: "orders-transform", Next: []string{"orders-sink"}},
+		{Name: "orders-sink", Plugin: "orders-sink"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sunk := false
+	pool := []*wrapper{
+		newRoutedWrapper("orders-transform", []string{"orders-reader"}, func(_ ouretl.DataMessage) {}),
+		newRoutedWrapper("orders-sink", nil, func(_ ouretl.DataMessage) {
+			sunk = true
+		}),
+	}
+
+	_ = p.process(context.Background(), pool, &DefaultDataMessage{id: "test", origin: "users-reader"}, func(error) {})
+
+	if sunk {
+		t.Error("Message from another source passed through a stage that does not accept it")
+	}
+}
@@ -0,0 +1,412 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ouretl "github.com/ourstudio-se/ouretl-abstractions"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultRuntimeBufferSize = 100
+
+var (
+	ErrRuntimeAlreadyStarted = errors.New("runtime has already been started")
+	ErrRuntimeNotStarted     = errors.New("runtime has not been started")
+	ErrRuntimeAlreadyStopped = errors.New("runtime has already been shut down")
+)
+
+// Runtime wires a worker pool and a handler pool together from a
+// config, and supports a graceful shutdown where in-flight messages
+// are drained through the handler chain before returning.
+type Runtime struct {
+	config   ouretl.Config
+	channel  chan *DefaultDataMessage
+	mu       sync.RWMutex
+	started  bool
+	shutdown int32
+	stopped  bool
+	stopping chan struct{}
+	draining chan struct{}
+	done     chan struct{}
+	drainCtx context.Context
+	dropped  int64
+	// sharded counts the messages dispatched to a shard and not yet
+	// processed, which are dropped if the drain deadline is exceeded.
+	sharded int64
+
+	messageTimeout      time.Duration
+	concurrency         int
+	preserveOriginOrder bool
+	handlerCtx          context.Context
+	handlerCancel       context.CancelFunc
+	workerCancel        context.CancelFunc
+	deadLetter          DeadLetterWriter
+	workersExhausted    chan struct{}
+	pipeline            *pipeline
+	workers             *workerPool
+}
+
+type messageTimeoutConfig interface {
+	MessageTimeout() time.Duration
+}
+
+type concurrencyConfig interface {
+	Concurrency() int
+	PreserveOriginOrder() bool
+}
+
+type deadLetterConfig interface {
+	deadLetterDefinition() *deadLetterDefinition
+}
+
+func NewRuntime(config ouretl.Config) *Runtime {
+	handlerCtx, handlerCancel := context.WithCancel(context.Background())
+
+	var messageTimeout time.Duration
+	if c, ok := config.(messageTimeoutConfig); ok {
+		messageTimeout = c.MessageTimeout()
+	}
+
+	concurrency := 1
+	preserveOriginOrder := false
+	if c, ok := config.(concurrencyConfig); ok {
+		if c.Concurrency() > 1 {
+			concurrency = c.Concurrency()
+		}
+		preserveOriginOrder = c.PreserveOriginOrder()
+	}
+
+	return &Runtime{
+		config:              config,
+		channel:             make(chan *DefaultDataMessage, defaultRuntimeBufferSize),
+		stopping:            make(chan struct{}),
+		draining:            make(chan struct{}),
+		done:                make(chan struct{}),
+		messageTimeout:      messageTimeout,
+		concurrency:         concurrency,
+		preserveOriginOrder: preserveOriginOrder,
+		handlerCtx:          handlerCtx,
+		handlerCancel:       handlerCancel,
+		workersExhausted:    make(chan struct{}),
+	}
+}
+
+// Start loads all worker and handler plugins from the config and starts
+// processing messages. It returns immediately; the runtime keeps running
+// until Shutdown is called. Workers implementing ContextWorkerPlugin are
+// given a context derived from ctx, which is cancelled on Shutdown.
+func (r *Runtime) Start(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	if r.started {
+		r.mu.Unlock()
+		return ErrRuntimeAlreadyStarted
+	}
+	r.started = true
+	r.mu.Unlock()
+
+	p, err := pipelineFromConfig(r.config)
+	if err != nil {
+		return err
+	}
+	r.pipeline = p
+
+	pool := newHandlerPoolFromConfig(r.config)
+	if c, ok := r.config.(deadLetterConfig); ok && c.deadLetterDefinition() != nil && r.deadLetter == nil {
+		def := c.deadLetterDefinition()
+		deadLetter, err := newDeadLetterWriter(def, pool)
+		if err != nil {
+			return err
+		}
+
+		r.deadLetter = deadLetter
+		if def.Type == deadLetterTypePlugin {
+			pool = withoutHandler(pool, def.Plugin)
+		}
+	}
+
+	workerCtx, workerCancel := context.WithCancel(ctx)
+	r.mu.Lock()
+	r.workerCancel = workerCancel
+	r.mu.Unlock()
+
+	go r.consume(pool)
+
+	var once sync.Once
+	workers := &workerPool{onExhausted: func() {
+		once.Do(func() {
+			close(r.workersExhausted)
+		})
+	}}
+	r.mu.Lock()
+	r.workers = workers
+	r.mu.Unlock()
+
+	newWorkerPoolFromConfig(workerCtx, workers, r.publish, r.config)
+	workers.exhaustedIfIdle()
+
+	return nil
+}
+
+// WorkersExhausted returns a channel that is closed when no worker is
+// running any more without having been stopped, either because no
+// worker could be started, or because every started worker gave up
+// according to its restart policy or exited under a policy that does
+// not restart it.
+func (r *Runtime) WorkersExhausted() <-chan struct{} {
+	return r.workersExhausted
+}
+
+// SetDeadLetterWriter sets the destination for messages that the handler
+// chain fails to process. It must be called before Start, and takes
+// precedence over a `[dead_letter]` section in the config.
+func (r *Runtime) SetDeadLetterWriter(w DeadLetterWriter) {
+	r.deadLetter = w
+}
+
+// Shutdown stops all workers from publishing new messages, and drains
+// the messages already accepted through the handler chain until either
+// everything is processed or ctx is done. It returns the number of
+// messages that were dropped, either because a worker published after
+// shutdown began or because the drain deadline was exceeded.
+func (r *Runtime) Shutdown(ctx context.Context) (int, error) {
+	r.mu.RLock()
+	started := r.started
+	r.mu.RUnlock()
+	if !started {
+		return 0, ErrRuntimeNotStarted
+	}
+	if !atomic.CompareAndSwapInt32(&r.shutdown, 0, 1) {
+		return 0, ErrRuntimeAlreadyStopped
+	}
+
+	close(r.stopping)
+
+	// Workers are stopped without holding r.mu, since a worker may still
+	// publish from its `Stop`, and publish needs the lock.
+	r.mu.RLock()
+	workers, workerCancel := r.workers, r.workerCancel
+	r.mu.RUnlock()
+	if workers != nil {
+		workers.stopAll()
+	}
+	if workerCancel != nil {
+		workerCancel()
+	}
+
+	r.mu.Lock()
+	r.stopped = true
+	r.drainCtx = ctx
+	r.mu.Unlock()
+
+	log.Infof("Draining %d messages", len(r.channel))
+	close(r.draining)
+
+	select {
+	case <-r.done:
+		r.handlerCancel()
+		r.closeDeadLetter()
+		dropped := int(atomic.LoadInt64(&r.dropped))
+		log.Infof("Runtime shut down, %d messages dropped", dropped)
+		return dropped, nil
+	case <-ctx.Done():
+		r.handlerCancel()
+		// Consumers stop once their current message is cancelled, and
+		// the dead letter writer is only closed after they have, so that
+		// it is flushed without racing their last writes.
+		go func() {
+			<-r.done
+			r.closeDeadLetter()
+		}()
+		dropped := int(atomic.LoadInt64(&r.dropped)+atomic.LoadInt64(&r.sharded)) + len(r.channel)
+		log.Warnf("Runtime shutdown deadline exceeded, %d messages dropped", dropped)
+		return dropped, ctx.Err()
+	}
+}
+
+func (r *Runtime) publish(ctx context.Context, dm *DefaultDataMessage) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.stopped {
+		atomic.AddInt64(&r.dropped, 1)
+		return
+	}
+
+	select {
+	case r.channel <- dm:
+	case <-r.stopping:
+		atomic.AddInt64(&r.dropped, 1)
+	case <-ctx.Done():
+		atomic.AddInt64(&r.dropped, 1)
+	}
+}
+
+func (r *Runtime) process(pool func() []*wrapper, dm *DefaultDataMessage) {
+	ctx := r.handlerCtx
+	if r.messageTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.messageTimeout)
+		defer cancel()
+	}
+
+	if r.pipeline == nil {
+		if err := proxyDataMessage(ctx, pool(), dm); err != nil {
+			r.writeDeadLetter(dm, err)
+		}
+		return
+	}
+
+	err := r.pipeline.process(ctx, pool(), dm, func(err error) {
+		r.writeDeadLetter(dm, err)
+	})
+	if err != nil {
+		log.Error(err)
+		r.writeDeadLetter(dm, err)
+	}
+}
+
+func (r *Runtime) writeDeadLetter(dm *DefaultDataMessage, err error) {
+	if r.deadLetter == nil {
+		return
+	}
+
+	if err := r.deadLetter.Write(newDeadLetter(dm, err)); err != nil {
+		log.Errorf("Message with ID '%s' could not be written as a dead letter: %v", dm.ID(), err)
+	}
+}
+
+func (r *Runtime) closeDeadLetter() {
+	if closer, ok := r.deadLetter.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Warn(err)
+		}
+	}
+}
+
+func (r *Runtime) consume(pool func() []*wrapper) {
+	defer close(r.done)
+
+	var wg sync.WaitGroup
+	if r.preserveOriginOrder && r.concurrency > 1 {
+		shards := make([]chan *DefaultDataMessage, r.concurrency)
+		for i := range shards {
+			shards[i] = make(chan *DefaultDataMessage, defaultRuntimeBufferSize)
+			wg.Add(1)
+			go r.consumeShard(pool, shards[i], &wg)
+		}
+
+		r.dispatch(shards)
+	} else {
+		for i := 0; i < r.concurrency; i++ {
+			wg.Add(1)
+			go r.consumeChannel(pool, &wg)
+		}
+	}
+
+	wg.Wait()
+}
+
+func (r *Runtime) consumeChannel(pool func() []*wrapper, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for {
+		select {
+		case msg := <-r.channel:
+			r.process(pool, msg)
+		case <-r.draining:
+			r.drain(pool)
+			return
+		}
+	}
+}
+
+func (r *Runtime) consumeShard(pool func() []*wrapper, shard <-chan *DefaultDataMessage, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for msg := range shard {
+		if ctx := r.drainContext(); ctx != nil && ctx.Err() != nil {
+			continue
+		}
+
+		r.process(pool, msg)
+		atomic.AddInt64(&r.sharded, -1)
+	}
+}
+
+// dispatch routes each message to a shard chosen by its origin, so that
+// messages from the same worker are always processed in the order they
+// were published. Shards are buffered, so that a burst from one worker
+// does not hold back the messages of other workers until its shard is
+// full.
+func (r *Runtime) dispatch(shards []chan *DefaultDataMessage) {
+	defer func() {
+		for _, shard := range shards {
+			close(shard)
+		}
+	}()
+
+	for {
+		select {
+		case msg := <-r.channel:
+			atomic.AddInt64(&r.sharded, 1)
+			shards[shardFor(msg.Origin(), len(shards))] <- msg
+		case <-r.draining:
+			ctx := r.drainContext()
+
+			for ctx.Err() == nil {
+				select {
+				case msg := <-r.channel:
+					atomic.AddInt64(&r.sharded, 1)
+					select {
+					case shards[shardFor(msg.Origin(), len(shards))] <- msg:
+					case <-ctx.Done():
+						return
+					}
+				default:
+					return
+				}
+			}
+			return
+		}
+	}
+}
+
+func (r *Runtime) drainContext() context.Context {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.drainCtx
+}
+
+func (r *Runtime) drain(pool func() []*wrapper) {
+	ctx := r.drainContext()
+
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		select {
+		case msg := <-r.channel:
+			r.process(pool, msg)
+		default:
+			return
+		}
+	}
+}
+
+func shardFor(origin string, count int) int {
+	h := fnv.New32a()
+	h.Write([]byte(origin))
+	return int(h.Sum32() % uint32(count))
+}
@@ -0,0 +1,258 @@
+package core
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	ouretl "github.com/ourstudio-se/ouretl-abstractions"
+)
+
+func TestThatShutdownOfUnstartedRuntimeFails(t *testing.T) {
+	rt := NewRuntime(newDefaultConfig())
+
+	_, err := rt.Shutdown(context.Background())
+	if err != ErrRuntimeNotStarted {
+		t.Errorf("Expected error '%v' but got '%v'", ErrRuntimeNotStarted, err)
+	}
+}
+
+func TestThatShutdownDrainsAcceptedMessages(t *testing.T) {
+	rt := NewRuntime(newDefaultConfig())
+	rt.started = true
+
+	handled := 0
+	p1 := &wrapper{
+		definition: &mockPluginDef{active: true},
+		implementation: &mockPluginImpl{handled: func() {
+			handled = handled + 1
+		}},
+	}
+
+	for i := 0; i < 5; i++ {
+		rt.publish(context.Background(), &DefaultDataMessage{id: "test", data: []byte("test")})
+	}
+
+	go rt.consume(func() []*wrapper { return []*wrapper{p1} })
+
+	dropped, err := rt.Shutdown(context.Background())
+	if err != nil {
+		t.Error(err)
+	}
+	if dropped != 0 {
+		t.Errorf("Expected no dropped messages, but %d were dropped", dropped)
+	}
+	if handled != 5 {
+		t.Errorf("Expected 5 handled messages, but %d were handled", handled)
+	}
+}
+
+func TestThatShutdownReportsMessagesDroppedAfterDeadline(t *testing.T) {
+	rt := NewRuntime(newDefaultConfig())
+	rt.started = true
+
+	p1 := &wrapper{
+		definition: &mockPluginDef{active: true},
+		implementation: &mockPluginImpl{handled: func() {
+			time.Sleep(50 * time.Millisecond)
+		}},
+	}
+
+	for i := 0; i < 5; i++ {
+		rt.publish(context.Background(), &DefaultDataMessage{id: "test", data: []byte("test")})
+	}
+
+	go rt.consume(func() []*wrapper { return []*wrapper{p1} })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	dropped, err := rt.Shutdown(ctx)
+	if err == nil {
+		t.Errorf("Expected deadline error when shutdown could not drain all messages")
+	}
+	if dropped == 0 {
+		t.Errorf("Expected dropped messages to be reported after deadline")
+	}
+
+	rt.publish(context.Background(), &DefaultDataMessage{id: "late", data: []byte("late")})
+}
+
+func TestThatConcurrentRuntimeProcessesMessagesInParallel(t *testing.T) {
+	config := newDefaultConfig().(*defaultConfig)
+	config.ConcurrencyVal = 4
+
+	rt := NewRuntime(config)
+	rt.started = true
+
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	p1 := &wrapper{
+		definition: &mockPluginDef{active: true},
+		implementation: &mockDataRecorder{record: func(_ ouretl.DataMessage) {
+			mu.Lock()
+			running = running + 1
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mu.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+
+			mu.Lock()
+			running = running - 1
+			mu.Unlock()
+		}},
+	}
+
+	for i := 0; i < 8; i++ {
+		rt.publish(context.Background(), &DefaultDataMessage{id: "test", data: []byte("test")})
+	}
+
+	go rt.consume(func() []*wrapper { return []*wrapper{p1} })
+
+	if _, err := rt.Shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if maxRunning < 2 {
+		t.Errorf("Expected messages to be processed in parallel, but at most %d ran at once", maxRunning)
+	}
+}
+
+func TestThatConcurrentRuntimePreservesOriginOrder(t *testing.T) {
+	config := newDefaultConfig().(*defaultConfig)
+	config.ConcurrencyVal = 4
+	config.PreserveOriginOrderVal = true
+
+	rt := NewRuntime(config)
+	rt.started = true
+
+	var mu sync.Mutex
+	received := make(map[string][]string)
+	p1 := &wrapper{
+		definition: &mockPluginDef{active: true},
+		implementation: &mockDataRecorder{record: func(dm ouretl.DataMessage) {
+			mu.Lock()
+			received[dm.Origin()] = append(received[dm.Origin()], string(dm.Data()))
+			mu.Unlock()
+		}},
+	}
+
+	origins := []string{"worker-a", "worker-b", "worker-c"}
+	for i := 0; i < 20; i++ {
+		for _, origin := range origins {
+			rt.publish(context.Background(), &DefaultDataMessage{id: "test", data: []byte(strconv.Itoa(i)), origin: origin})
+		}
+	}
+
+	go rt.consume(func() []*wrapper { return []*wrapper{p1} })
+
+	if _, err := rt.Shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+
+	for _, origin := range origins {
+		if len(received[origin]) != 20 {
+			t.Errorf("Expected 20 messages from '%s', but received %d", origin, len(received[origin]))
+		}
+		for i, data := range received[origin] {
+			if data != strconv.Itoa(i) {
+				t.Errorf("Message %d from '%s' was processed out of order", i, origin)
+				break
+			}
+		}
+	}
+}
+
+func TestThatBusyOriginDoesNotHoldBackOtherOrigins(t *testing.T) {
+	config := newDefaultConfig().(*defaultConfig)
+	config.ConcurrencyVal = 2
+	config.PreserveOriginOrderVal = true
+
+	rt := NewRuntime(config)
+	rt.started = true
+
+	busy, other := "worker-a", "worker-b"
+	for shardFor(other, 2) == shardFor(busy, 2) {
+		other = other + "b"
+	}
+
+	release := make(chan struct{})
+	processed := make(chan struct{})
+	p1 := &wrapper{
+		definition: &mockPluginDef{active: true},
+		implementation: &mockDataRecorder{record: func(dm ouretl.DataMessage) {
+			if dm.Origin() == busy {
+				<-release
+				return
+			}
+			close(processed)
+		}},
+	}
+
+	for i := 0; i < 5; i++ {
+		rt.publish(context.Background(), &DefaultDataMessage{id: "test", data: []byte("test"), origin: busy})
+	}
+	rt.publish(context.Background(), &DefaultDataMessage{id: "test", data: []byte("test"), origin: other})
+
+	go rt.consume(func() []*wrapper { return []*wrapper{p1} })
+
+	select {
+	case <-processed:
+	case <-time.After(time.Second):
+		t.Errorf("Expected message from '%s' to be processed while '%s' is busy", other, busy)
+	}
+
+	close(release)
+	if _, err := rt.Shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+type mockDataRecorder struct {
+	record func(ouretl.DataMessage)
+}
+
+func (m *mockDataRecorder) Handle(dm ouretl.DataMessage, next func([]byte) error) error {
+	m.record(dm)
+	return next(dm.Data())
+}
+
+type mockFlushingWorkerImpl struct {
+	flush func()
+}
+
+func (m *mockFlushingWorkerImpl) Stop() error {
+	m.flush()
+	return nil
+}
+
+func TestThatShutdownDoesNotBlockWorkersPublishingOnStop(t *testing.T) {
+	rt := NewRuntime(newDefaultConfig())
+	rt.started = true
+
+	// A message published while the worker stops has passed the check
+	// for a stopped worker, so it reaches the runtime directly.
+	stopper := &mockFlushingWorkerImpl{flush: func() {
+		rt.publish(context.Background(), &DefaultDataMessage{id: "flushed", data: []byte("flushed")})
+	}}
+	pdef := &defaultPluginDefinition{NameVal: "worker-1", VersionVal: "1.0.0"}
+	rt.workers = &workerPool{}
+	rt.workers.started(&runningWorker{definition: pdef, cancel: func() {}, stopper: stopper})
+
+	go rt.consume(func() []*wrapper { return nil })
+
+	done := make(chan struct{})
+	go func() {
+		_, _ = rt.Shutdown(context.Background())
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown blocked on a worker publishing from `Stop`")
+	}
+}
@@ -0,0 +1,361 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	secretPrefix          = "secret:"
+	secretFilePrefix      = "file://"
+	secretEnvPrefix       = "env:"
+	secretEncryptedPrefix = "enc:"
+	secretKeySize         = 32
+	minRedactedSecretSize = 6
+	redacted              = "[REDACTED]"
+)
+
+// secretRedactor replaces every resolved secret in log lines, including
+// lines logged by plugins through the standard logger. Secrets are kept
+// per owner, i.e. per plugin, so that secrets are no longer redacted
+// once the settings of their plugin are re-read without them.
+type secretRedactor struct {
+	mu      sync.RWMutex
+	once    sync.Once
+	owners  map[string][]string
+	secrets []string
+}
+
+var redactor = &secretRedactor{}
+
+// set replaces the secrets of an owner, and rebuilds the list of
+// secrets to redact.
+func (sr *secretRedactor) set(owner string, secrets []string) {
+	if len(secrets) > 0 {
+		sr.once.Do(func() {
+			log.AddHook(sr)
+		})
+	}
+
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	if equalSecrets(sr.owners[owner], secrets) {
+		return
+	}
+	if sr.owners == nil {
+		sr.owners = make(map[string][]string)
+	}
+	if len(secrets) == 0 {
+		delete(sr.owners, owner)
+	} else {
+		sr.owners[owner] = secrets
+	}
+
+	seen := make(map[string]bool)
+	var all []string
+	for _, ownerSecrets := range sr.owners {
+		for _, secret := range ownerSecrets {
+			if !seen[secret] {
+				seen[secret] = true
+				all = append(all, secret)
+			}
+		}
+	}
+
+	// Longer secrets are replaced first, so that a secret containing
+	// another one is not partially redacted.
+	sort.Slice(all, func(i, j int) bool {
+		if len(all[i]) != len(all[j]) {
+			return len(all[i]) > len(all[j])
+		}
+		return all[i] < all[j]
+	})
+	sr.secrets = all
+}
+
+func equalSecrets(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (sr *secretRedactor) redact(s string) string {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+
+	for _, secret := range sr.secrets {
+		if len(secret) < minRedactedSecretSize {
+			s = replaceToken(s, secret, redacted)
+			continue
+		}
+		s = strings.Replace(s, secret, redacted, -1)
+	}
+
+	return s
+}
+
+// replaceToken replaces the occurrences of a short secret which are not
+// part of a longer word, so that redacting it does not mangle unrelated
+// words in log lines.
+func replaceToken(s string, token string, replacement string) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, token)
+		if i < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+
+		end := i + len(token)
+		if isWordEnd(s[:i], true) && isWordEnd(s[end:], false) {
+			b.WriteString(s[:i])
+			b.WriteString(replacement)
+		} else {
+			b.WriteString(s[:end])
+		}
+		s = s[end:]
+	}
+}
+
+// isWordEnd tells if a token next to s is not part of a longer word,
+// where s is the text before the token if before is set, or after it.
+func isWordEnd(s string, before bool) bool {
+	if s == "" {
+		return true
+	}
+
+	r, _ := utf8.DecodeRuneInString(s)
+	if before {
+		r, _ = utf8.DecodeLastRuneInString(s)
+	}
+
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+func (sr *secretRedactor) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (sr *secretRedactor) Fire(entry *log.Entry) error {
+	entry.Message = sr.redact(entry.Message)
+	for key, value := range entry.Data {
+		switch v := value.(type) {
+		case string:
+			entry.Data[key] = sr.redact(v)
+		case error:
+			entry.Data[key] = sr.redact(v.Error())
+		}
+	}
+
+	return nil
+}
+
+// GenerateSecretKey returns a new random key for sealing secrets, in the
+// format expected in a `secret_key_file`.
+func GenerateSecretKey() (string, error) {
+	key := make([]byte, secretKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// ReadSecretKeyFile reads a base64 encoded 256 bit key, as created by
+// GenerateSecretKey.
+func ReadSecretKeyFile(keyFilePath string) ([]byte, error) {
+	content, err := ioutil.ReadFile(keyFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil || len(key) != secretKeySize {
+		return nil, fmt.Errorf("secret key file '%s' does not contain a base64 encoded %d byte key", keyFilePath, secretKeySize)
+	}
+
+	return key, nil
+}
+
+func newSecretCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// SealSecret encrypts a secret with AES-256-GCM, and returns it as a
+// `secret:enc:` value which can be used in plugin settings.
+func SealSecret(key []byte, secret string) (string, error) {
+	aead, err := newSecretCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(secret), nil)
+	return secretPrefix + secretEncryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func openSecret(key []byte, value string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, secretEncryptedPrefix))
+	if err != nil {
+		return "", errors.New("encrypted secret is not valid base64")
+	}
+
+	aead, err := newSecretCipher(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("encrypted secret is too short")
+	}
+
+	secret, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("encrypted secret could not be decrypted with the secret key")
+	}
+
+	return string(secret), nil
+}
+
+// secretResolver resolves secret references in settings values. The
+// key file is only read once an encrypted value is found.
+type secretResolver struct {
+	keyFilePath string
+	key         []byte
+	secrets     []string
+	keys        map[string]bool
+}
+
+// resolve returns the secret a `secret:` value refers to, and any other
+// value as it is, so that a plain `file://` URL keeps its meaning.
+func (r *secretResolver) resolve(key string, value string) (string, error) {
+	if !strings.HasPrefix(value, secretPrefix) {
+		return value, nil
+	}
+	value = strings.TrimPrefix(value, secretPrefix)
+
+	var secret string
+	switch {
+	case strings.HasPrefix(value, secretFilePrefix):
+		content, err := ioutil.ReadFile(strings.TrimPrefix(value, secretFilePrefix))
+		if err != nil {
+			return "", fmt.Errorf("setting '%s' refers to a secret file that cannot be read: %v", key, err)
+		}
+		secret = strings.TrimRight(string(content), "\r\n")
+	case strings.HasPrefix(value, secretEnvPrefix):
+		name := strings.TrimPrefix(value, secretEnvPrefix)
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("setting '%s' refers to environment variable '%s', which is not set", key, name)
+		}
+		secret = v
+	case strings.HasPrefix(value, secretEncryptedPrefix):
+		if r.key == nil {
+			if r.keyFilePath == "" {
+				return "", fmt.Errorf("setting '%s' is encrypted, but no `secret_key_file` is configured", key)
+			}
+
+			k, err := ReadSecretKeyFile(r.keyFilePath)
+			if err != nil {
+				return "", fmt.Errorf("setting '%s' is encrypted, but the secret key could not be read: %v", key, err)
+			}
+			r.key = k
+		}
+
+		v, err := openSecret(r.key, value)
+		if err != nil {
+			return "", fmt.Errorf("setting '%s': %v", key, err)
+		}
+		secret = v
+	default:
+		return "", fmt.Errorf("setting '%s' refers to a secret without `file://`, `env:` or `enc:`", key)
+	}
+
+	if r.keys == nil {
+		r.keys = make(map[string]bool)
+	}
+	r.keys[key] = true
+	r.secrets = append(r.secrets, r.redactable(secret)...)
+
+	return secret, nil
+}
+
+// redactable returns the secrets of a setting to redact, which is none
+// for an empty secret.
+func (r *secretResolver) redactable(secret string) []string {
+	if secret == "" {
+		return nil
+	}
+
+	return []string{secret}
+}
+
+// resolveSecrets returns a copy of a settings value, including nested
+// tables and arrays, where secret references are replaced with the
+// secrets they refer to.
+func (r *secretResolver) resolveSecrets(key string, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return r.resolve(key, v)
+	case map[string]interface{}:
+		table := make(map[string]interface{}, len(v))
+		for k, x := range v {
+			resolved, err := r.resolveSecrets(joinSettingKey(key, k), x)
+			if err != nil {
+				return nil, err
+			}
+			table[k] = resolved
+		}
+		return table, nil
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, x := range v {
+			resolved, err := r.resolveSecrets(key, x)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = resolved
+		}
+		return list, nil
+	}
+
+	return value, nil
+}
+
+func joinSettingKey(parent, key string) string {
+	if parent == "" {
+		return key
+	}
+
+	return parent + "." + key
+}
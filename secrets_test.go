@@ -0,0 +1,190 @@
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestThatSecretReferencesAreResolved(t *testing.T) {
+	keyFilePath := "/tmp/secret1.key"
+	key, _ := GenerateSecretKey()
+	ioutil.WriteFile(keyFilePath, []byte(key+"\n"), 0600)
+	decodedKey, err := ReadSecretKeyFile(keyFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, _ := SealSecret(decodedKey, "sealed-password")
+
+	ioutil.WriteFile("/tmp/secret1", []byte("file-password\n"), 0600)
+	os.Setenv("TEST_SECRET_PASSWORD", "env-password")
+	defer os.Unsetenv("TEST_SECRET_PASSWORD")
+
+	configFilePath := "/tmp/config15.conf"
+	configString := "secret_key_file = \"" + keyFilePath + "\"\n\n[[plugin]]\nname = \"test-1\"\nbuiltin = \"router\"\nversion = \"1.0.0\"\n\n[plugin.settings]\nfrom_file = \"secret:file:///tmp/secret1\"\nfrom_env = \"secret:env:TEST_SECRET_PASSWORD\"\n\n[plugin.settings.db]\npassword = \"" + sealed + "\"\n"
+	ioutil.WriteFile(configFilePath, []byte(configString), 0600)
+
+	config, err := readConfigFromFile(configFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings := Settings(config.PluginDefinitions()[0].Settings())
+	if v, _ := settings.GetString("from_file"); v != "file-password" {
+		t.Errorf("Expected secret from file to be 'file-password', but got '%s'", v)
+	}
+	if v, _ := settings.GetString("from_env"); v != "env-password" {
+		t.Errorf("Expected secret from environment to be 'env-password', but got '%s'", v)
+	}
+
+	db, err := settings.GetTable("db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := db.GetString("password"); v != "sealed-password" {
+		t.Errorf("Expected encrypted secret to be 'sealed-password', but got '%s'", v)
+	}
+}
+
+func TestThatUnresolvableSecretFailsPluginSettings(t *testing.T) {
+	os.Unsetenv("TEST_MISSING_SECRET")
+
+	configFilePath := "/tmp/config16.conf"
+	configString := "[[plugin]]\nname = \"test-1\"\nbuiltin = \"router\"\nversion = \"1.0.0\"\n\n[plugin.settings]\npassword = \"secret:env:TEST_MISSING_SECRET\"\ntoken = \"secret:enc:AAAA\"\n"
+	ioutil.WriteFile(configFilePath, []byte(configString), 0600)
+
+	_, err := NewStrictConfigFromTOMLFile(configFilePath)
+	if err == nil || !strings.Contains(err.Error(), "has invalid settings") {
+		t.Errorf("Expected unresolvable secret to fail strict config, but got '%v'", err)
+	}
+}
+
+func TestThatResolvedSecretsAreRedactedFromLogs(t *testing.T) {
+	var buffer bytes.Buffer
+	log.SetOutput(&buffer)
+	defer log.SetOutput(os.Stderr)
+
+	ioutil.WriteFile("/tmp/secret2", []byte("s3cr3t-value"), 0600)
+	if _, err := readSettings("test-1@1.0.0", map[string]interface{}{"password": "secret:file:///tmp/secret2"}, "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	log.WithField("password", "s3cr3t-value").Errorf("Could not connect with password 's3cr3t-value'")
+
+	if strings.Contains(buffer.String(), "s3cr3t-value") {
+		t.Errorf("Expected secret to be redacted from log line, but got '%s'", buffer.String())
+	}
+	if !strings.Contains(buffer.String(), redacted) {
+		t.Errorf("Expected log line to tell that a secret was redacted, but got '%s'", buffer.String())
+	}
+}
+
+func TestThatRedactedSecretsAreReplacedWhenSettingsAreReread(t *testing.T) {
+	var buffer bytes.Buffer
+	log.SetOutput(&buffer)
+	defer log.SetOutput(os.Stderr)
+
+	os.Setenv("TEST_ROTATED_SECRET", "old-password")
+	defer os.Unsetenv("TEST_ROTATED_SECRET")
+	inline := map[string]interface{}{"password": "secret:env:TEST_ROTATED_SECRET"}
+	if _, err := readSettings("test-2@1.0.0", inline, "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("TEST_ROTATED_SECRET", "new-password")
+	if _, err := readSettings("test-2@1.0.0", inline, "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	log.Errorf("Connecting with 'new-password' after 'old-password'")
+
+	if strings.Contains(buffer.String(), "new-password") {
+		t.Errorf("Expected new secret to be redacted from log line, but got '%s'", buffer.String())
+	}
+	if !strings.Contains(buffer.String(), "old-password") {
+		t.Errorf("Expected old secret to no longer be redacted, but got '%s'", buffer.String())
+	}
+}
+
+func TestThatShortSecretsAreRedactedAsWholeWords(t *testing.T) {
+	var buffer bytes.Buffer
+	log.SetOutput(&buffer)
+	defer log.SetOutput(os.Stderr)
+
+	os.Setenv("TEST_SHORT_SECRET", "pin1")
+	defer os.Unsetenv("TEST_SHORT_SECRET")
+	settings, err := readSettings("test-3@1.0.0", map[string]interface{}{"pin": "secret:env:TEST_SHORT_SECRET"}, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := settings.Get("pin"); v != "pin1" {
+		t.Errorf("Expected short secret to be resolved to 'pin1', but got '%v'", v)
+	}
+
+	buffer.Reset()
+	log.Errorf("Unlocking spin1 with pin1, pin1:spin10")
+
+	if strings.Contains(buffer.String(), " pin1") || strings.Contains(buffer.String(), ",pin1") {
+		t.Errorf("Expected short secret to be redacted, but got '%s'", buffer.String())
+	}
+	if !strings.Contains(buffer.String(), "Unlocking spin1 with [REDACTED], [REDACTED]:spin10") {
+		t.Errorf("Expected words containing short secret to be kept, but got '%s'", buffer.String())
+	}
+}
+
+func TestThatEnvOverridesResolveAndRedactSecrets(t *testing.T) {
+	var buffer bytes.Buffer
+	log.SetOutput(&buffer)
+	defer log.SetOutput(os.Stderr)
+
+	ioutil.WriteFile("/tmp/secret3", []byte("file-password"), 0600)
+	os.Setenv("TEST_OVERRIDE_TOKEN", "override-token")
+	os.Setenv("OURETL_SECRETS_TOKEN", "secret:env:TEST_OVERRIDE_TOKEN")
+	os.Setenv("OURETL_SECRETS_PASSWORD", "override-password")
+	defer os.Unsetenv("TEST_OVERRIDE_TOKEN")
+	defer os.Unsetenv("OURETL_SECRETS_TOKEN")
+	defer os.Unsetenv("OURETL_SECRETS_PASSWORD")
+
+	settings, err := readSettings("test-4@1.0.0", map[string]interface{}{"password": "secret:file:///tmp/secret3"}, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.overrideFromEnv = true
+	settings.envPrefix = "OURETL_SECRETS_"
+
+	if v, _ := settings.Get("token"); v != "override-token" {
+		t.Errorf("Expected overriding secret reference to be resolved, but got '%v'", v)
+	}
+	if v, _ := settings.Get("password"); v != "override-password" {
+		t.Errorf("Expected setting 'password' to be overridden, but got '%v'", v)
+	}
+
+	log.Errorf("Connecting with 'override-token' and 'override-password'")
+
+	if strings.Contains(buffer.String(), "override-token") || strings.Contains(buffer.String(), "override-password") {
+		t.Errorf("Expected overriding secrets to be redacted from log line, but got '%s'", buffer.String())
+	}
+}
+
+func TestThatValuesWithoutSecretPrefixAreKept(t *testing.T) {
+	ioutil.WriteFile("/tmp/secret4", []byte("file-content"), 0600)
+
+	settings, err := readSettings("test-5@1.0.0", map[string]interface{}{"input": "file:///tmp/secret4", "mode": "env:production"}, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := settings.Get("input"); v != "file:///tmp/secret4" {
+		t.Errorf("Expected 'file://' URL to be kept, but got '%v'", v)
+	}
+	if v, _ := settings.Get("mode"); v != "env:production" {
+		t.Errorf("Expected 'env:' value to be kept, but got '%v'", v)
+	}
+
+	if _, err := readSettings("test-5@1.0.0", map[string]interface{}{"input": "secret:vault://x"}, "", "", ""); err == nil {
+		t.Error("Expected unknown secret reference to cause an error")
+	}
+}
@@ -0,0 +1,98 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"plugin"
+	"strings"
+
+	ouretl "github.com/ourstudio-se/ouretl-abstractions"
+)
+
+// Types of settings that can be declared in a SettingsSchema.
+const (
+	SettingString     = "string"
+	SettingInt        = "int"
+	SettingFloat      = "float"
+	SettingBool       = "bool"
+	SettingDuration   = "duration"
+	SettingStringList = "string_list"
+	SettingTable      = "table"
+)
+
+// SettingSchema declares a setting read by a plugin.
+type SettingSchema struct {
+	Key      string
+	Type     string
+	Required bool
+}
+
+// SettingsSchema declares the settings read by a plugin. A plugin can
+// expose it through a `GetSettingsSchema` symbol of type
+// `func() core.SettingsSchema`, in which case the settings are validated
+// before the plugin is created, and the plugin is not loaded if they
+// do not match.
+type SettingsSchema []SettingSchema
+
+func checkSettingType(s SettingSchema, value interface{}) error {
+	var err error
+	switch s.Type {
+	case SettingString:
+		_, err = asString(s.Key, value)
+	case SettingInt:
+		_, err = asInt(s.Key, value)
+	case SettingFloat:
+		_, err = asFloat(s.Key, value)
+	case SettingBool:
+		_, err = asBool(s.Key, value)
+	case SettingDuration:
+		_, err = asDuration(s.Key, value)
+	case SettingStringList:
+		_, err = asStringList(s.Key, value)
+	case SettingTable:
+		_, err = asTable(s.Key, value)
+	default:
+		err = fmt.Errorf("setting '%s' has unknown type '%s' in schema", s.Key, s.Type)
+	}
+
+	return err
+}
+
+// validate tells every setting which is required but missing, or which
+// cannot be read as its declared type.
+func (schema SettingsSchema) validate(settings ouretl.PluginSettings) error {
+	var problems []string
+	for _, s := range schema {
+		value, ok := settings.Get(s.Key)
+		if !ok {
+			if s.Required {
+				problems = append(problems, fmt.Sprintf("setting '%s' is required", s.Key))
+			}
+			continue
+		}
+
+		if err := checkSettingType(s, value); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+func validateSettingsSchema(p *plugin.Plugin, definition ouretl.PluginDefinition) error {
+	symbol, err := p.Lookup("GetSettingsSchema")
+	if err != nil {
+		return nil
+	}
+
+	fn, ok := symbol.(func() SettingsSchema)
+	if !ok {
+		return errors.New("`GetSettingsSchema` does not have a valid function declaration")
+	}
+
+	return fn().validate(definition.Settings())
+}
@@ -0,0 +1,44 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestThatSettingsSchemaReportsAllProblems(t *testing.T) {
+	schema := SettingsSchema{
+		{Key: "url", Type: SettingString, Required: true},
+		{Key: "batch_size", Type: SettingInt},
+		{Key: "timeout", Type: SettingDuration, Required: true},
+		{Key: "optional", Type: SettingBool},
+	}
+
+	err := schema.validate(newTestSettings(map[string]interface{}{
+		"batch_size": "many",
+		"timeout":    "10s",
+	}))
+	if err == nil {
+		t.Fatal("Expected settings not matching schema to cause an error")
+	}
+
+	for _, problem := range []string{"setting 'url' is required", "setting 'batch_size' with value 'many' cannot be read as an int"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("Expected error to contain '%s', but got '%v'", problem, err)
+		}
+	}
+}
+
+func TestThatMatchingSettingsPassSchema(t *testing.T) {
+	schema := SettingsSchema{
+		{Key: "url", Type: SettingString, Required: true},
+		{Key: "hosts", Type: SettingStringList},
+	}
+
+	err := schema.validate(newTestSettings(map[string]interface{}{
+		"url":   "http://localhost",
+		"hosts": []interface{}{"a"},
+	}))
+	if err != nil {
+		t.Error(err)
+	}
+}
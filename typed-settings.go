@@ -0,0 +1,331 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	ouretl "github.com/ourstudio-se/ouretl-abstractions"
+)
+
+// ErrSettingNotFound is returned by the typed getters of
+// TypedPluginSettings when a setting is missing.
+var ErrSettingNotFound = errors.New("setting not found")
+
+// TypedPluginSettings reads settings as a specific type. Values are
+// coerced the same way whether they come from TOML or from the
+// environment, where every value is a string: `"10"` is read as an
+// int, `"true"` as a bool and `"a, b"` as a string list.
+type TypedPluginSettings interface {
+	ouretl.PluginSettings
+	GetString(key string) (string, error)
+	GetInt(key string) (int64, error)
+	GetFloat(key string) (float64, error)
+	GetBool(key string) (bool, error)
+	GetDuration(key string) (time.Duration, error)
+	GetStringList(key string) ([]string, error)
+	GetTable(key string) (TypedPluginSettings, error)
+}
+
+// Settings returns typed getters for the settings a plugin was created
+// with.
+func Settings(settings ouretl.PluginSettings) TypedPluginSettings {
+	if ts, ok := settings.(TypedPluginSettings); ok {
+		return ts
+	}
+
+	tps := &typedPluginSettings{PluginSettings: settings}
+	if es, ok := settings.(envOverrideSettings); ok {
+		tps.overrideFromEnv, tps.envPrefix = es.envOverride()
+	}
+
+	return tps
+}
+
+// envOverrideSettings is implemented by settings which are overridden
+// from the environment, so that their nested tables are overridden the
+// same way.
+type envOverrideSettings interface {
+	envOverride() (bool, string)
+}
+
+type typedPluginSettings struct {
+	ouretl.PluginSettings
+	overrideFromEnv bool
+	envPrefix       string
+}
+
+func lookupSetting(settings ouretl.PluginSettings, key string) (interface{}, error) {
+	value, ok := settings.Get(key)
+	if !ok {
+		return nil, fmt.Errorf("setting '%s': %w", key, ErrSettingNotFound)
+	}
+
+	return value, nil
+}
+
+func settingError(key string, value interface{}, typeName string) error {
+	return fmt.Errorf("setting '%s' with value '%v' cannot be read as %s", key, value, typeName)
+}
+
+func asString(key string, value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case int64, float64, bool:
+		return fmt.Sprint(v), nil
+	}
+
+	return "", settingError(key, value, "a string")
+}
+
+func asInt(key string, value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case int64:
+		return v, nil
+	case float64:
+		if v == float64(int64(v)) {
+			return int64(v), nil
+		}
+	case string:
+		if i, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+			return i, nil
+		}
+	}
+
+	return 0, settingError(key, value, "an int")
+}
+
+func asFloat(key string, value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	case string:
+		if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+			return f, nil
+		}
+	}
+
+	return 0, settingError(key, value, "a float")
+}
+
+func asBool(key string, value interface{}) (bool, error) {
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case string:
+		if b, err := strconv.ParseBool(strings.TrimSpace(v)); err == nil {
+			return b, nil
+		}
+	}
+
+	return false, settingError(key, value, "a bool")
+}
+
+func asDuration(key string, value interface{}) (time.Duration, error) {
+	if v, ok := value.(string); ok {
+		if d, err := time.ParseDuration(strings.TrimSpace(v)); err == nil {
+			return d, nil
+		}
+	}
+
+	return 0, settingError(key, value, "a duration")
+}
+
+// asStringList reads a TOML array, or a comma separated string such as
+// an environment variable, as a string list.
+func asStringList(key string, value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, x := range v {
+			s, err := asString(key, x)
+			if err != nil {
+				return nil, settingError(key, value, "a string list")
+			}
+			list = append(list, s)
+		}
+		return list, nil
+	case string:
+		list := []string{}
+		for _, x := range strings.Split(v, ",") {
+			if x = strings.TrimSpace(x); x != "" {
+				list = append(list, x)
+			}
+		}
+		return list, nil
+	}
+
+	return nil, settingError(key, value, "a string list")
+}
+
+func asTable(key string, value interface{}) (map[string]interface{}, error) {
+	if v, ok := value.(map[string]interface{}); ok {
+		return v, nil
+	}
+
+	return nil, settingError(key, value, "a table")
+}
+
+func getString(settings ouretl.PluginSettings, key string) (string, error) {
+	value, err := lookupSetting(settings, key)
+	if err != nil {
+		return "", err
+	}
+
+	return asString(key, value)
+}
+
+func getInt(settings ouretl.PluginSettings, key string) (int64, error) {
+	value, err := lookupSetting(settings, key)
+	if err != nil {
+		return 0, err
+	}
+
+	return asInt(key, value)
+}
+
+func getFloat(settings ouretl.PluginSettings, key string) (float64, error) {
+	value, err := lookupSetting(settings, key)
+	if err != nil {
+		return 0, err
+	}
+
+	return asFloat(key, value)
+}
+
+func getBool(settings ouretl.PluginSettings, key string) (bool, error) {
+	value, err := lookupSetting(settings, key)
+	if err != nil {
+		return false, err
+	}
+
+	return asBool(key, value)
+}
+
+func getDuration(settings ouretl.PluginSettings, key string) (time.Duration, error) {
+	value, err := lookupSetting(settings, key)
+	if err != nil {
+		return 0, err
+	}
+
+	return asDuration(key, value)
+}
+
+func getStringList(settings ouretl.PluginSettings, key string) ([]string, error) {
+	value, err := lookupSetting(settings, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return asStringList(key, value)
+}
+
+func (tps *typedPluginSettings) GetString(key string) (string, error) {
+	return getString(tps, key)
+}
+
+func (tps *typedPluginSettings) GetInt(key string) (int64, error) {
+	return getInt(tps, key)
+}
+
+func (tps *typedPluginSettings) GetFloat(key string) (float64, error) {
+	return getFloat(tps, key)
+}
+
+func (tps *typedPluginSettings) GetBool(key string) (bool, error) {
+	return getBool(tps, key)
+}
+
+func (tps *typedPluginSettings) GetDuration(key string) (time.Duration, error) {
+	return getDuration(tps, key)
+}
+
+func (tps *typedPluginSettings) GetStringList(key string) ([]string, error) {
+	return getStringList(tps, key)
+}
+
+func (tps *typedPluginSettings) GetTable(key string) (TypedPluginSettings, error) {
+	value, err := lookupSetting(tps, key)
+	if err != nil {
+		return nil, err
+	}
+
+	table, err := asTable(key, value)
+	if err != nil {
+		return nil, err
+	}
+
+	return &defaultPluginSettings{
+		settings:        table,
+		overrideFromEnv: tps.overrideFromEnv,
+		envPrefix:       envNameFor(tps.envPrefix, key) + "_",
+	}, nil
+}
+
+func (dps *defaultPluginSettings) GetString(key string) (string, error) {
+	return getString(dps, key)
+}
+
+func (dps *defaultPluginSettings) GetInt(key string) (int64, error) {
+	return getInt(dps, key)
+}
+
+func (dps *defaultPluginSettings) GetFloat(key string) (float64, error) {
+	return getFloat(dps, key)
+}
+
+func (dps *defaultPluginSettings) GetBool(key string) (bool, error) {
+	return getBool(dps, key)
+}
+
+func (dps *defaultPluginSettings) GetDuration(key string) (time.Duration, error) {
+	return getDuration(dps, key)
+}
+
+func (dps *defaultPluginSettings) GetStringList(key string) ([]string, error) {
+	return getStringList(dps, key)
+}
+
+// GetTable returns a nested table of settings. Its settings are
+// overridden from the environment by variables prefixed with the key of
+// the table, e.g. `OURETL_HTTP_WRITER_TLS_ENABLED` for `tls.enabled`.
+func (dps *defaultPluginSettings) GetTable(key string) (TypedPluginSettings, error) {
+	dps.mu.RLock()
+	value, ok := dps.settings[key]
+	dps.mu.RUnlock()
+
+	if !ok && dps.fallback != nil {
+		value, ok = dps.fallback.Get(key)
+	}
+	if !ok {
+		return nil, fmt.Errorf("setting '%s': %w", key, ErrSettingNotFound)
+	}
+
+	table, err := asTable(key, value)
+	if err != nil {
+		return nil, err
+	}
+
+	dps.mu.RLock()
+	secretKeys := make(map[string]bool)
+	for secretKey := range dps.secretKeys {
+		if strings.HasPrefix(secretKey, key+".") {
+			secretKeys[strings.TrimPrefix(secretKey, key+".")] = true
+		}
+	}
+	dps.mu.RUnlock()
+
+	return &defaultPluginSettings{
+		settings:        table,
+		overrideFromEnv: dps.overrideFromEnv,
+		envPrefix:       dps.envName(key) + "_",
+		owner:           dps.owner,
+		secretKeyFile:   dps.secretKeyFile,
+		secretKeys:      secretKeys,
+	}, nil
+}
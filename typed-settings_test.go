@@ -0,0 +1,144 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestSettings(settings map[string]interface{}) *defaultPluginSettings {
+	return &defaultPluginSettings{
+		settings:        settings,
+		overrideFromEnv: true,
+		envPrefix:       "OURETL_TYPED_",
+	}
+}
+
+func TestThatTypedSettingsReadTOMLValues(t *testing.T) {
+	settings := Settings(newTestSettings(map[string]interface{}{
+		"name":    "writer",
+		"size":    int64(10),
+		"ratio":   0.5,
+		"enabled": true,
+		"timeout": "5s",
+		"hosts":   []interface{}{"a", "b"},
+		"tls":     map[string]interface{}{"enabled": true},
+	}))
+
+	if v, err := settings.GetString("name"); err != nil || v != "writer" {
+		t.Errorf("Expected 'writer', but got '%v' (%v)", v, err)
+	}
+	if v, err := settings.GetInt("size"); err != nil || v != 10 {
+		t.Errorf("Expected 10, but got '%v' (%v)", v, err)
+	}
+	if v, err := settings.GetFloat("ratio"); err != nil || v != 0.5 {
+		t.Errorf("Expected 0.5, but got '%v' (%v)", v, err)
+	}
+	if v, err := settings.GetBool("enabled"); err != nil || !v {
+		t.Errorf("Expected true, but got '%v' (%v)", v, err)
+	}
+	if v, err := settings.GetDuration("timeout"); err != nil || v != 5*time.Second {
+		t.Errorf("Expected 5s, but got '%v' (%v)", v, err)
+	}
+	if v, err := settings.GetStringList("hosts"); err != nil || !reflect.DeepEqual(v, []string{"a", "b"}) {
+		t.Errorf("Expected [a b], but got '%v' (%v)", v, err)
+	}
+
+	tls, err := settings.GetTable("tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := tls.GetBool("enabled"); err != nil || !v {
+		t.Errorf("Expected true, but got '%v' (%v)", v, err)
+	}
+}
+
+func TestThatTypedSettingsCoerceEnvValues(t *testing.T) {
+	env := map[string]string{
+		"OURETL_TYPED_SIZE":        "20",
+		"OURETL_TYPED_RATIO":       "1.5",
+		"OURETL_TYPED_ENABLED":     "false",
+		"OURETL_TYPED_TIMEOUT":     "1m",
+		"OURETL_TYPED_HOSTS":       "c, d",
+		"OURETL_TYPED_TLS_ENABLED": "false",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	settings := Settings(newTestSettings(map[string]interface{}{
+		"size":    int64(10),
+		"enabled": true,
+		"hosts":   []interface{}{"a", "b"},
+		"tls":     map[string]interface{}{"enabled": true},
+	}))
+
+	if v, err := settings.GetInt("size"); err != nil || v != 20 {
+		t.Errorf("Expected 20, but got '%v' (%v)", v, err)
+	}
+	if v, err := settings.GetFloat("ratio"); err != nil || v != 1.5 {
+		t.Errorf("Expected 1.5, but got '%v' (%v)", v, err)
+	}
+	if v, err := settings.GetBool("enabled"); err != nil || v {
+		t.Errorf("Expected false, but got '%v' (%v)", v, err)
+	}
+	if v, err := settings.GetDuration("timeout"); err != nil || v != time.Minute {
+		t.Errorf("Expected 1m, but got '%v' (%v)", v, err)
+	}
+	if v, err := settings.GetStringList("hosts"); err != nil || !reflect.DeepEqual(v, []string{"c", "d"}) {
+		t.Errorf("Expected [c d], but got '%v' (%v)", v, err)
+	}
+
+	tls, err := settings.GetTable("tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := tls.GetBool("enabled"); err != nil || v {
+		t.Errorf("Expected false, but got '%v' (%v)", v, err)
+	}
+}
+
+func TestThatTypedSettingsReportMissingAndInvalidValues(t *testing.T) {
+	settings := Settings(newTestSettings(map[string]interface{}{
+		"size": "large",
+	}))
+
+	if _, err := settings.GetString("missing"); !errors.Is(err, ErrSettingNotFound) {
+		t.Errorf("Expected error '%v', but got '%v'", ErrSettingNotFound, err)
+	}
+	if _, err := settings.GetInt("size"); err == nil || errors.Is(err, ErrSettingNotFound) {
+		t.Errorf("Expected type error, but got '%v'", err)
+	}
+}
+
+type mockEnvSettings struct {
+	settings *defaultPluginSettings
+}
+
+func (m *mockEnvSettings) Get(key string) (interface{}, bool) {
+	return m.settings.Get(key)
+}
+
+func (m *mockEnvSettings) envOverride() (bool, string) {
+	return m.settings.envOverride()
+}
+
+func TestThatTablesOfWrappedSettingsAreOverriddenFromEnv(t *testing.T) {
+	os.Setenv("OURETL_TYPED_TLS_ENABLED", "false")
+	defer os.Unsetenv("OURETL_TYPED_TLS_ENABLED")
+
+	settings := Settings(&mockEnvSettings{newTestSettings(map[string]interface{}{
+		"tls": map[string]interface{}{"enabled": true},
+	})})
+
+	tls, err := settings.GetTable("tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := tls.GetBool("enabled"); err != nil || v {
+		t.Errorf("Expected table setting to be overridden to false, but got '%v' (%v)", v, err)
+	}
+}
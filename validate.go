@@ -0,0 +1,84 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	ouretl "github.com/ourstudio-se/ouretl-abstractions"
+)
+
+// ValidationError lists every problem found in a config file, and is
+// returned when reading a config in strict mode. FilePath is empty for a
+// config built with a ConfigBuilder.
+type ValidationError struct {
+	FilePath string
+	Problems []string
+}
+
+func (ve *ValidationError) Error() string {
+	if ve.FilePath == "" {
+		return fmt.Sprintf("config has %d problem(s): %s", len(ve.Problems), strings.Join(ve.Problems, "; "))
+	}
+
+	return fmt.Sprintf("config file '%s' has %d problem(s): %s", ve.FilePath, len(ve.Problems), strings.Join(ve.Problems, "; "))
+}
+
+// ValidateConfigFile reads the config file in strict mode, and returns
+// a *ValidationError listing all problems found, if any. If format is
+// empty, it is picked by the extension of the file.
+func ValidateConfigFile(configFilePath string, format string) error {
+	format, err := formatFor(configFilePath, format)
+	if err != nil {
+		return err
+	}
+
+	_, err = readConfig(configFilePath, format, true)
+	return err
+}
+
+func describe(pdef ouretl.PluginDefinition) string {
+	return fmt.Sprintf("plugin '%s (v%s)'", pdef.Name(), pdef.Version())
+}
+
+// validateConfig returns the problems with a decoded config, before any
+// defaults have been applied to it. Problems with settings files are
+// found when they are read.
+func validateConfig(config *defaultConfig, undecoded []string) []string {
+	var problems []string
+
+	for _, key := range undecoded {
+		problems = append(problems, fmt.Sprintf("unknown key '%s'", key))
+	}
+
+	seen := make(map[string]bool)
+	priorities := make(map[int]string)
+	for _, def := range config.Definitions {
+		key := workerKey(def)
+		if seen[key] {
+			problems = append(problems, fmt.Sprintf("%s is declared more than once", describe(def)))
+		}
+		seen[key] = true
+
+		if def.PriorityVal > 0 {
+			if other, ok := priorities[def.PriorityVal]; ok && other != def.NameVal {
+				problems = append(problems, fmt.Sprintf("%s has the same priority %d as plugin '%s'", describe(def), def.PriorityVal, other))
+			}
+			priorities[def.PriorityVal] = def.NameVal
+		}
+
+		if def.BuiltinVal == "" {
+			if def.PathVal == "" {
+				problems = append(problems, fmt.Sprintf("%s has no path", describe(def)))
+			} else if _, err := os.Stat(def.PathVal); err != nil {
+				problems = append(problems, fmt.Sprintf("%s refers to a plugin file that cannot be found: %v", describe(def), err))
+			}
+		}
+	}
+
+	if _, err := pipelineFromConfig(config); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	return problems
+}
@@ -0,0 +1,70 @@
+package core
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestThatStrictConfigReportsAllProblems(t *testing.T) {
+	configFilePath := "/tmp/config8.conf"
+	configString := "default_plugin_path = \"/tmp/plugins\"\n\n[[plugin]]\nname = \"test-1\"\npath = \"/tmp/missing-plugin.so\"\nversion = \"1.0.0\"\npriority = 1\nactive = false\n\n[[plugin]]\nname = \"test-1\"\nbuiltin = \"router\"\nversion = \"1.0.0\"\n\n[[plugin]]\nname = \"test-2\"\nbuiltin = \"router\"\nversion = \"1.0.0\"\npriority = 1\nsettings_file = \"/tmp/missing-settings.toml\"\n"
+	ioutil.WriteFile(configFilePath, []byte(configString), 0600)
+
+	_, err := NewStrictConfigFromTOMLFile(configFilePath)
+	ve, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("Expected a validation error, but got '%v'", err)
+	}
+
+	expected := []string{
+		"unknown key 'default_plugin_path'",
+		"unknown key 'plugin.active'",
+		"plugin 'test-1 (v1.0.0)' refers to a plugin file that cannot be found",
+		"plugin 'test-1 (v1.0.0)' is declared more than once",
+		"plugin 'test-2 (v1.0.0)' has the same priority 1 as plugin 'test-1'",
+		"plugin 'test-2 (v1.0.0)' has invalid settings: settings file '/tmp/missing-settings.toml'",
+	}
+	if len(ve.Problems) != len(expected) {
+		t.Fatalf("Expected %d problems, but got %d: %v", len(expected), len(ve.Problems), ve.Problems)
+	}
+	for i, problem := range expected {
+		if !strings.HasPrefix(ve.Problems[i], problem) {
+			t.Errorf("Expected problem '%s', but got '%s'", problem, ve.Problems[i])
+		}
+	}
+}
+
+func TestThatNonStrictConfigIgnoresProblems(t *testing.T) {
+	configFilePath := "/tmp/config9.conf"
+	configString := "default_plugin_path = \"/tmp/plugins\"\n\n[[plugin]]\nname = \"test-1\"\npath = \"/tmp/missing-plugin.so\"\nversion = \"1.0.0\"\n"
+	ioutil.WriteFile(configFilePath, []byte(configString), 0600)
+
+	config, err := readConfigFromFile(configFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.PluginDefinitions()) != 1 {
+		t.Errorf("Expected plugin count of 1 did not match read value count of %d", len(config.PluginDefinitions()))
+	}
+}
+
+func TestThatValidConfigPassesValidation(t *testing.T) {
+	configFilePath := "/tmp/config10.conf"
+	configString := "[[plugin]]\nname = \"router-1\"\nbuiltin = \"router\"\nversion = \"1.0.0\"\npriority = 1\n\n[[plugin.rule]]\nroute = \"all\"\n\n[[plugin]]\nname = \"router-2\"\nbuiltin = \"router\"\nversion = \"1.0.0\"\npriority = 2\n"
+	ioutil.WriteFile(configFilePath, []byte(configString), 0600)
+
+	if err := ValidateConfigFile(configFilePath, ""); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestThatNestedInlineSettingsAreNotUnknownKeys(t *testing.T) {
+	configFilePath := "/tmp/config26.conf"
+	configString := "[[plugin]]\nname = \"router-1\"\nbuiltin = \"router\"\nversion = \"1.0.0\"\n\n[plugin.settings]\nendpoint = \"http://localhost\"\n\n[plugin.settings.tls]\nenabled = true\n\n[[plugin.settings.hosts]]\nname = \"a\"\n"
+	ioutil.WriteFile(configFilePath, []byte(configString), 0600)
+
+	if err := ValidateConfigFile(configFilePath, ""); err != nil {
+		t.Error(err)
+	}
+}
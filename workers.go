@@ -1,21 +1,112 @@
 package core
 
 import (
+	"context"
 	"plugin"
-	"time"
+	"sort"
+	"sync"
 
 	ouretl "github.com/ourstudio-se/ouretl-abstractions"
 	uuid "github.com/satori/go.uuid"
 	log "github.com/sirupsen/logrus"
 )
 
+// ContextWorkerPlugin is a context aware variant of ouretl.WorkerPlugin.
+// A plugin opts in by exposing a `GetWorkerWithContext` symbol instead
+// of `GetWorker`:
+//
+//	func GetWorkerWithContext(_ ouretl.Config, _ ouretl.PluginSettings) (core.ContextWorkerPlugin, error)
+//
+// The context passed to Start is cancelled when the runtime shuts down,
+// and a worker is expected to return from Start when that happens. The
+// context passed to `target` bounds the time spent publishing a message.
+type ContextWorkerPlugin interface {
+	Start(ctx context.Context, target func(context.Context, []byte)) error
+}
+
+// HeaderWorkerPlugin is a variant of ContextWorkerPlugin where the
+// `target` function also accepts message headers, which are available
+// to every DataHandlerPlugin through HeaderedDataMessage. A plugin opts
+// in by exposing a `GetWorkerWithHeaders` symbol:
+//
+//	func GetWorkerWithHeaders(_ ouretl.Config, _ ouretl.PluginSettings) (core.HeaderWorkerPlugin, error)
+type HeaderWorkerPlugin interface {
+	Start(ctx context.Context, target func(context.Context, []byte, map[string]string)) error
+}
+
+type legacyWorker struct {
+	worker ouretl.WorkerPlugin
+}
+
+func (lw *legacyWorker) Start(ctx context.Context, target func(context.Context, []byte, map[string]string)) error {
+	return lw.worker.Start(func(data []byte) {
+		target(ctx, data, nil)
+	})
+}
+
+type contextWorker struct {
+	worker ContextWorkerPlugin
+}
+
+func (cw *contextWorker) Start(ctx context.Context, target func(context.Context, []byte, map[string]string)) error {
+	return cw.worker.Start(ctx, func(ctx context.Context, data []byte) {
+		target(ctx, data, nil)
+	})
+}
+
+type backgroundWorker struct {
+	worker HeaderWorkerPlugin
+}
+
+func (bw *backgroundWorker) Start(target func([]byte)) error {
+	return bw.worker.Start(context.Background(), func(_ context.Context, data []byte, _ map[string]string) {
+		target(data)
+	})
+}
+
 func NewWorker(definition ouretl.PluginDefinition, config ouretl.Config) ouretl.WorkerPlugin {
-	p, err := plugin.Open(definition.FilePath())
+	worker := newWorker(definition, config)
+	if worker == nil {
+		return nil
+	}
+
+	if lw, ok := worker.(*legacyWorker); ok {
+		return lw.worker
+	}
+
+	return &backgroundWorker{worker: worker}
+}
+
+func newWorker(definition ouretl.PluginDefinition, config ouretl.Config) HeaderWorkerPlugin {
+	if builtinFor(definition) != "" {
+		log.Debugf("Plugin '%s (v%s)' is a built-in `DataHandlerPlugin` -- it will be excluded from worker pool", definition.Name(), definition.Version())
+		return nil
+	}
+
+	if err := settingsErrorFor(definition); err != nil {
+		log.Errorf("Plugin '%s (v%s)' has invalid settings -- it will be excluded from worker pool: %v", definition.Name(), definition.Version(), err)
+		return nil
+	}
+
+	p, filePath, err := openPlugin(definition)
 	if err != nil {
-		log.Errorf("Plugin '%s (v%s)' could not be found at path '%s': %s, definition.Name(), definition.Version(), definition.FilePath(), err.Error()")
+		logPluginOpenError(definition, filePath, err)
 		return nil
 	}
 
+	if err := validateSettingsSchema(p, definition); err != nil {
+		log.Errorf("Plugin '%s (v%s)' settings do not match its schema -- it will be excluded from worker pool: %v", definition.Name(), definition.Version(), err)
+		return nil
+	}
+
+	if actor, err := p.Lookup("GetWorkerWithHeaders"); err == nil {
+		return newHeaderWorker(actor, definition, config)
+	}
+
+	if actor, err := p.Lookup("GetWorkerWithContext"); err == nil {
+		return newContextWorker(actor, definition, config)
+	}
+
 	actor, err := p.Lookup("GetWorker")
 	if err != nil {
 		log.Debugf("Plugin '%s (v%s)' did not expose a `GetWorker` symbol -- it will be excluded from worker pool", definition.Name(), definition.Version())
@@ -36,65 +127,384 @@ func NewWorker(definition ouretl.PluginDefinition, config ouretl.Config) ouretl.
 
 	log.Infof("Plugin '%s (v%s)' successfully loaded as a `WorkerPlugin`", definition.Name(), definition.Version())
 
+	return &legacyWorker{worker: worker}
+}
+
+// isWorkerPlugin tells if a definition refers to a plugin exposing a
+// `WorkerPlugin`, without loading it.
+func isWorkerPlugin(definition ouretl.PluginDefinition) bool {
+	if builtinFor(definition) != "" {
+		return false
+	}
+
+	return exposesSymbol(definition, "GetWorkerWithHeaders", "GetWorkerWithContext", "GetWorker")
+}
+
+func newHeaderWorker(actor plugin.Symbol, definition ouretl.PluginDefinition, config ouretl.Config) HeaderWorkerPlugin {
+	retriever, ok := actor.(func(ouretl.Config, ouretl.PluginSettings) (HeaderWorkerPlugin, error))
+	if !ok {
+		log.Errorf("Plugin '%s (v%s)' was loaded as a `HeaderWorkerPlugin`, but does not expose a valid function declaration -- it will be excluded from worker pool", definition.Name(), definition.Version())
+		return nil
+	}
+
+	worker, err := retriever(config, definition.Settings())
+	if err != nil {
+		log.Errorf("Plugin '%s (v%s)' could not be loaded as a `HeaderWorkerPlugin`, received error: %v", definition.Name(), definition.Version(), err)
+		return nil
+	}
+
+	log.Infof("Plugin '%s (v%s)' successfully loaded as a `HeaderWorkerPlugin`", definition.Name(), definition.Version())
+
 	return worker
 }
 
+func newContextWorker(actor plugin.Symbol, definition ouretl.PluginDefinition, config ouretl.Config) HeaderWorkerPlugin {
+	retriever, ok := actor.(func(ouretl.Config, ouretl.PluginSettings) (ContextWorkerPlugin, error))
+	if !ok {
+		log.Errorf("Plugin '%s (v%s)' was loaded as a `ContextWorkerPlugin`, but does not expose a valid function declaration -- it will be excluded from worker pool", definition.Name(), definition.Version())
+		return nil
+	}
+
+	worker, err := retriever(config, definition.Settings())
+	if err != nil {
+		log.Errorf("Plugin '%s (v%s)' could not be loaded as a `ContextWorkerPlugin`, received error: %v", definition.Name(), definition.Version(), err)
+		return nil
+	}
+
+	log.Infof("Plugin '%s (v%s)' successfully loaded as a `ContextWorkerPlugin`", definition.Name(), definition.Version())
+
+	return &contextWorker{worker: worker}
+}
+
+// StoppableWorkerPlugin can be implemented by any worker plugin, to be
+// told to stop when its definition is deactivated in the config or the
+// runtime shuts down. Start is expected to return once Stop is called.
+type StoppableWorkerPlugin interface {
+	Stop() error
+}
+
+// unwrapWorker returns the worker implementation as exposed by the
+// plugin, for detecting optional capabilities.
+func unwrapWorker(worker HeaderWorkerPlugin) interface{} {
+	switch x := worker.(type) {
+	case *legacyWorker:
+		return x.worker
+	case *contextWorker:
+		return x.worker
+	}
+
+	return worker
+}
+
+func stopperFor(worker HeaderWorkerPlugin) StoppableWorkerPlugin {
+	s, _ := unwrapWorker(worker).(StoppableWorkerPlugin)
+	return s
+}
+
+type runningWorker struct {
+	definition ouretl.PluginDefinition
+	worker     HeaderWorkerPlugin
+	ctx        context.Context
+	cancel     context.CancelFunc
+	stopper    StoppableWorkerPlugin
+}
+
+// wasStopped tells if the worker exited because it was stopped, rather
+// than on its own.
+func (rw *runningWorker) wasStopped() bool {
+	return rw.ctx != nil && rw.ctx.Err() != nil
+}
+
+func (rw *runningWorker) stop() {
+	rw.cancel()
+
+	if rw.stopper == nil {
+		log.Debugf("WorkerPlugin '%s (v%s)' does not implement `Stop`, messages it publishes will be dropped", rw.definition.Name(), rw.definition.Version())
+		return
+	}
+
+	if err := rw.stopper.Stop(); err != nil {
+		log.Warnf("WorkerPlugin '%s (v%s)' could not be stopped: %v", rw.definition.Name(), rw.definition.Version(), err)
+	}
+}
+
+// workerPool keeps track of the workers started from a config, so that
+// they can be stopped individually, and reports when every one of them
+// has terminally stopped.
+type workerPool struct {
+	mu          sync.Mutex
+	workers     map[string]*runningWorker
+	skipped     skippedDefinitions
+	running     int
+	onExhausted func()
+}
+
+func workerKey(pdef ouretl.PluginDefinition) string {
+	return pdef.Name() + "@" + pdef.Version()
+}
+
+func (wp *workerPool) started(rw *runningWorker) int {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+
+	if wp.workers == nil {
+		wp.workers = make(map[string]*runningWorker)
+	}
+
+	wp.workers[workerKey(rw.definition)] = rw
+	wp.running = wp.running + 1
+	return wp.running
+}
+
+// sources returns the names of the running workers, sorted.
+func (wp *workerPool) sources() []string {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+
+	sources := make([]string, 0, len(wp.workers))
+	for _, rw := range wp.workers {
+		sources = append(sources, rw.definition.Name())
+	}
+	sort.Strings(sources)
+
+	return sources
+}
+
+func (wp *workerPool) find(pdef ouretl.PluginDefinition) *runningWorker {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+
+	return wp.workers[workerKey(pdef)]
+}
+
+func (wp *workerPool) isRunning(pdef ouretl.PluginDefinition) bool {
+	return wp.find(pdef) != nil
+}
+
+func (wp *workerPool) exited(rw *runningWorker, err error) {
+	wp.mu.Lock()
+	if wp.workers[workerKey(rw.definition)] == rw {
+		delete(wp.workers, workerKey(rw.definition))
+	}
+	wp.running = wp.running - 1
+	running := wp.running
+	wp.mu.Unlock()
+
+	if rw.wasStopped() {
+		return
+	}
+
+	if err != nil {
+		log.Errorf("WorkerPlugin '%s' has terminally stopped: %v", rw.definition.Name(), err)
+	} else {
+		log.Warnf("WorkerPlugin '%s' has stopped on its own", rw.definition.Name())
+	}
+
+	if running == 0 {
+		log.Error("All `WorkerPlugin` implementations have terminally stopped")
+		wp.exhausted()
+	}
+}
+
+// exhaustedIfIdle reports exhaustion if no worker is running, such as
+// when no worker could be started at all.
+func (wp *workerPool) exhaustedIfIdle() {
+	wp.mu.Lock()
+	running := wp.running
+	wp.mu.Unlock()
+
+	if running == 0 {
+		log.Error("No `WorkerPlugin` implementation is running")
+		wp.exhausted()
+	}
+}
+
+func (wp *workerPool) exhausted() {
+	if wp.onExhausted != nil {
+		wp.onExhausted()
+	}
+}
+
+// stop stops the worker for a definition and removes it from the pool
+// right away, since a worker without `Stop` may never return from
+// `Start`, and would otherwise keep the definition from being started
+// again.
+func (wp *workerPool) stop(pdef ouretl.PluginDefinition) bool {
+	wp.mu.Lock()
+	rw := wp.workers[workerKey(pdef)]
+	delete(wp.workers, workerKey(pdef))
+	wp.mu.Unlock()
+
+	if rw != nil {
+		rw.stop()
+	}
+
+	return rw != nil
+}
+
+func (wp *workerPool) stopAll() {
+	wp.mu.Lock()
+	var workers []*runningWorker
+	for key, rw := range wp.workers {
+		workers = append(workers, rw)
+		delete(wp.workers, key)
+	}
+	wp.mu.Unlock()
+
+	for _, rw := range workers {
+		rw.stop()
+	}
+}
+
 func NewWorkerPool(channel chan<- *DefaultDataMessage, config ouretl.Config) []string {
-	var sources []string
+	pool := &workerPool{}
+	newWorkerPool(context.Background(), pool, newChannelPublisher(channel), config)
+	return pool.sources()
+}
+
+func newWorkerPool(ctx context.Context, pool *workerPool, publish func(context.Context, *DefaultDataMessage), config ouretl.Config) {
 	for _, definition := range config.PluginDefinitions() {
-		worker := NewWorker(definition, config)
+		if !definition.IsActive() {
+			continue
+		}
+
+		worker := newWorker(definition, config)
 		if worker == nil {
+			pool.skipped.add(definition, isWorkerPlugin)
 			continue
 		}
 
-		sources = append(sources, definition.Name())
-		startWorker(worker, channel, definition.Name())
+		startWorker(ctx, pool, worker, publish, definition)
 	}
-
-	return sources
 }
 
 func NewWorkerPoolFromConfig(channel chan<- *DefaultDataMessage, config ouretl.Config) {
-	pool := NewWorkerPool(channel, config)
+	newWorkerPoolFromConfig(context.Background(), &workerPool{}, newChannelPublisher(channel), config)
+}
+
+// newWorkerPoolFromConfig starts all workers in the config, and keeps
+// the pool in sync with it: added or activated definitions are started,
+// and deactivated definitions are stopped. A worker skipped because of
+// invalid settings is started once its settings change.
+func newWorkerPoolFromConfig(ctx context.Context, pool *workerPool, publish func(context.Context, *DefaultDataMessage), config ouretl.Config) {
+	newWorkerPool(ctx, pool, publish, config)
+
+	load := func(pdef ouretl.PluginDefinition) {
+		if pool.isRunning(pdef) {
+			return
+		}
+
+		worker := newWorker(pdef, config)
+		if worker == nil {
+			pool.skipped.add(pdef, isWorkerPlugin)
+			return
+		}
+
+		count := startWorker(ctx, pool, worker, publish, pdef)
+		log.Infof("`WorkerPlugin` '%s (v%s)' added, a total of %d `WorkerPlugin` implementations running", pdef.Name(), pdef.Version(), count)
+	}
 
 	config.OnPluginDefinitionAdded(func(pdef ouretl.PluginDefinition) {
-		worker := NewWorker(pdef, config)
-		if worker != nil {
-			pool = append(pool, pdef.Name())
-			startWorker(worker, channel, pdef.Name())
-			log.Infof("`DataHandlerPlugin` '%s (v%s)' added, a total of %d `DataHandlerPlugin` implementations loaded", pdef.Name(), pdef.Version(), len(pool))
+		if pdef.IsActive() {
+			load(pdef)
 		}
 	})
 
-	log.Infof("%d `WorkerPlugin` implementations loaded", len(pool))
-}
+	config.OnPluginDefinitionActivated(load)
 
-func startWorker(worker ouretl.WorkerPlugin, channel chan<- *DefaultDataMessage, name string) {
-	proxy := newMessageProxy(channel, name)
-	go initiateWorker(worker, proxy, name)
+	config.OnPluginDefinitionDeactivated(func(pdef ouretl.PluginDefinition) {
+		if pool.stop(pdef) {
+			log.Infof("`WorkerPlugin` '%s (v%s)' stopped after being deactivated", pdef.Name(), pdef.Version())
+		}
+	})
+
+	if c, ok := config.(fileChangeListenerConfig); ok {
+		c.OnPluginSettingsChanged(func(pdef ouretl.PluginDefinition) {
+			rw := pool.find(pdef)
+			if rw == nil {
+				if pdef.IsActive() && pool.skipped.retry(pdef) {
+					load(pdef)
+				}
+				return
+			}
+
+			if notifySettingsChanged(unwrapWorker(rw.worker), pdef) {
+				log.Infof("`WorkerPlugin` '%s (v%s)' notified of changed settings", pdef.Name(), pdef.Version())
+			}
+		})
+
+		c.OnPluginBinaryChanged(func(pdef ouretl.PluginDefinition) {
+			previous := pool.find(pdef)
+			if previous == nil {
+				return
+			}
+
+			worker := newWorker(pdef, config)
+			if worker == nil {
+				log.Warnf("`WorkerPlugin` '%s (v%s)' binary changed, but could not be loaded -- keeping the previous instance running", pdef.Name(), pdef.Version())
+				return
+			}
+
+			previous.stop()
+			startWorker(ctx, pool, worker, publish, pdef)
+			log.Infof("`WorkerPlugin` '%s (v%s)' restarted with changed binary", pdef.Name(), pdef.Version())
+		})
+	}
+
+	log.Infof("%d `WorkerPlugin` implementations loaded", len(pool.sources()))
 }
 
-func initiateWorker(worker ouretl.WorkerPlugin, proxy func([]byte), name string) {
-	err := worker.Start(proxy)
-	if err != nil {
-		log.Error(err)
-		log.Infof("Restarting worker '%s'...", name)
+func startWorker(ctx context.Context, pool *workerPool, worker HeaderWorkerPlugin, publish func(context.Context, *DefaultDataMessage), definition ouretl.PluginDefinition) int {
+	name := definition.Name()
+	workerCtx, cancel := context.WithCancel(ctx)
+	rw := &runningWorker{
+		definition: definition,
+		worker:     worker,
+		ctx:        workerCtx,
+		cancel:     cancel,
+		stopper:    stopperFor(worker),
+	}
 
-		time.Sleep(1 * time.Second)
-		initiateWorker(worker, proxy, name)
-	} else {
-		log.Warnf("WorkerPlugin '%s' has exited without error", name)
+	proxy := newMessageProxy(publish, name, pipelineNameFor(definition))
+	gated := func(c context.Context, data []byte, headers map[string]string) {
+		if workerCtx.Err() != nil {
+			log.Debugf("WorkerPlugin '%s' has been stopped, dropping published message", name)
+			return
+		}
+
+		proxy(c, data, headers)
+	}
+
+	count := pool.started(rw)
+
+	go func() {
+		err := initiateWorker(workerCtx, worker, gated, name, restartPolicyFor(definition))
+		pool.exited(rw, err)
+	}()
+
+	return count
+}
+
+func newChannelPublisher(channel chan<- *DefaultDataMessage) func(context.Context, *DefaultDataMessage) {
+	return func(ctx context.Context, dm *DefaultDataMessage) {
+		select {
+		case channel <- dm:
+		case <-ctx.Done():
+			log.Warnf("Message with ID '%s' from worker '%s' was dropped: %v", dm.ID(), dm.Origin(), ctx.Err())
+		}
 	}
 }
 
-func newMessageProxy(channel chan<- *DefaultDataMessage, name string) func([]byte) {
-	return func(data []byte) {
+func newMessageProxy(publish func(context.Context, *DefaultDataMessage), name, pipeline string) func(context.Context, []byte, map[string]string) {
+	return func(ctx context.Context, data []byte, headers map[string]string) {
 		dataMessage := &DefaultDataMessage{
-			id:     uuid.NewV4().String(),
-			data:   data,
-			origin: name,
+			id:       uuid.NewV4().String(),
+			data:     data,
+			origin:   name,
+			pipeline: pipeline,
+			headers:  copyHeaders(headers),
 		}
-		channel <- dataMessage
+		publish(ctx, dataMessage)
 	}
 }
 